@@ -2,9 +2,9 @@ module github.com/malklera/sliner
 
 go 1.25.1
 
-require golang.org/x/sys v0.36.0
-
 require (
-	github.com/mattn/go-runewidth v0.0.16 // indirect
-	github.com/rivo/uniseg v0.2.0 // indirect
+	github.com/mattn/go-runewidth v0.0.16
+	golang.org/x/sys v0.36.0
 )
+
+require github.com/rivo/uniseg v0.2.0 // indirect
@@ -5,6 +5,11 @@ import (
 	"container/ring"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type commonState struct {
@@ -20,11 +25,97 @@ type commonState struct {
 	shouldRestart     ShouldRestart
 	noBeep            bool
 	needRefresh       bool
+	passwordMask      rune
+	history           []string
+	historyMutex      sync.RWMutex
+	completer         WordCompleter
+	tabStyle          TabStyle
+	multiLineMode     bool
+	softWrap          bool
+	newlineKey        rune
+	deadline          time.Duration
+	idleTimeout       time.Duration
+	timeoutSubmits    bool
+	viMode            bool
+	bindings          map[Key]Command
+	validator         Validator
+	liveValidation    bool
+	invalid           bool
+	message           string
+	maxLength         int
+	maxWidth          int
+	runeFilter        func(rune) bool
+	highlighter       Highlighter
+	autoSuggester     AutoSuggester
+	pasteMode         PasteMode
+	styling           bool
 }
 
+// HistoryLimit is the maximum number of entries saved in the scrollback history.
+const HistoryLimit = 1000
+
+// HistoryLineMax is the maximum length in bytes of an escaped history entry
+// accepted by ReadHistory.
+const HistoryLineMax = 4096
+
 // KillRingMax is the max number of elements to save on the killring.
 const KillRingMax = 60
 
+// Completer takes the currently edited line and returns a list of completion
+// candidates. A picked candidate replaces the whole line.
+type Completer func(line string) []string
+
+// WordCompleter takes the currently edited line with the cursor position and
+// returns the completion candidates for the partial word to be completed.
+// If the line is "Hello, wo!!!" and the cursor is before the first '!',
+// ("Hello, wo!!!", 9) is passed to the completer which may return
+// ("Hello, ", {"world", "Word"}, "!!!") to have "Hello, world!!!".
+// The cursor is left at the end of the inserted candidate.
+type WordCompleter func(line string, pos int) (head string, completions []string, tail string)
+
+// Validator checks the edited line when the user presses Enter. If it returns
+// an error, the line is not accepted: the error is shown below the input and
+// editing goes on.
+type Validator func(line string) error
+
+// Highlighter returns line with SGR sequences (ESC [ ... m) added to color
+// it. It must not change anything else, or the line is drawn without them.
+type Highlighter func(line []rune) string
+
+// AutoSuggester returns a line starting with the edited line, the rest of
+// which is shown dimmed after the cursor as a suggestion, or "" to suggest
+// nothing. State.HistoryAutoSuggestion suggests from history.
+type AutoSuggester func(line string) string
+
+// TabStyle is used to select how tab completions are displayed.
+type TabStyle int
+
+// Two tab styles are currently available:
+//
+// TabCircular cycles through each completion item and displays it directly on
+// the prompt
+//
+// TabPrints completes the longest common prefix of the candidates, and prints
+// the list of candidates in columns after a second tab key is pressed. This
+// behaves similar to GNU readline and BASH (which uses readline)
+const (
+	TabCircular TabStyle = iota
+	TabPrints
+)
+
+// PasteMode tells what happens to the newlines in pasted text.
+type PasteMode int
+
+// PasteJoin, the default, turns the newlines of pasted text into spaces.
+// PasteKeep keeps them in multi-line mode, and joins the lines otherwise.
+// PasteSubmit inserts the text up to the first newline and accepts the line,
+// the rest is dropped.
+const (
+	PasteJoin PasteMode = iota
+	PasteKeep
+	PasteSubmit
+)
+
 // ShouldRestart is passed the error generated by readNext and returns true if
 // the the read should be restarted or false if the error should be returned.
 type ShouldRestart func(err error) bool
@@ -36,7 +127,7 @@ type ModeApplier interface {
 }
 
 // ErrInvalidPrompt is returned is a given prompt contains any unprintable runes
-// (including substrings that could be colour codes on some platforms).
+// other than newlines, SGR colour sequences and OSC 8 hyperlinks.
 var ErrInvalidPrompt = errors.New("invalid prompt, unprintable runes not allowed")
 
 // ErrNotTerminalOutput is returned from Prompt or PasswordPrompt if the
@@ -55,12 +146,330 @@ var ErrTemporary = errors.New("temporary error, update this message when i learn
 // if SetCtrlCAborts(true) has been called on the State
 var ErrPromptAborted = errors.New("prompt aborted")
 
+// ErrPromptTimeout is returned from Prompt or PasswordPrompt when the deadline
+// or idle timeout set with SetDeadline or SetIdleTimeout expires. Prompt
+// submits the line instead if SetTimeoutSubmits(true) has been called on the
+// State; PasswordPrompt never submits a partly typed password
+var ErrPromptTimeout = errors.New("prompt timed out")
+
+// ErrPasswordUnsupported is returned from PasswordPrompt when the input would
+// have to be read through the echoing fallback (redirected input, a dumb or
+// too narrow terminal)
+var ErrPasswordUnsupported = errors.New("password prompt not supported on this terminal")
+
+// SetCtrlCAborts sets whether Prompt or PasswordPrompt on a supported terminal
+// will return an ErrPromptAborted when Ctrl-C is pressed. The default is false
+// (will not return when Ctrl-C is pressed).
+func (s *commonState) SetCtrlCAborts(aborts bool) {
+	s.ctrlCAborts = aborts
+}
+
+// SetDeadline sets how long the user has to complete every following prompt.
+// The default, 0, sets no deadline.
+func (s *commonState) SetDeadline(d time.Duration) {
+	s.deadline = d
+}
+
+// SetIdleTimeout sets how long a prompt waits for the next key press. The
+// default, 0, waits forever.
+func (s *commonState) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout = d
+}
+
+// SetTimeoutSubmits sets whether Prompt submits the line being edited when the
+// deadline or idle timeout expires. The default is false (ErrPromptTimeout is
+// returned). PasswordPrompt returns ErrPromptTimeout either way.
+func (s *commonState) SetTimeoutSubmits(submits bool) {
+	s.timeoutSubmits = submits
+}
+
+// SetPasswordMask sets the rune PasswordPrompt echoes for every typed rune. The
+// default, 0, echoes nothing.
+func (s *commonState) SetPasswordMask(mask rune) {
+	s.passwordMask = mask
+}
+
+// SetCompleter sets the completion function that Liner will call to
+// fetch completion candidates when the user presses tab.
+func (s *commonState) SetCompleter(f Completer) {
+	if f == nil {
+		s.completer = nil
+		return
+	}
+	s.completer = func(line string, pos int) (string, []string, string) {
+		return "", f(line), ""
+	}
+}
+
+// SetWordCompleter sets the completion function that Liner will call to
+// fetch completion candidates when the user presses tab. Only the word under
+// the cursor is replaced, the text after the cursor is kept.
+func (s *commonState) SetWordCompleter(f WordCompleter) {
+	s.completer = f
+}
+
+// SetTabCompletionStyle sets the behaviour when the Tab key is pressed for
+// auto-completion. TabCircular is the default behaviour and cycles through the
+// list of candidates at the prompt. TabPrints will print the available
+// completion candidates to the screen similar to BASH and GNU Readline.
+func (s *commonState) SetTabCompletionStyle(tabStyle TabStyle) {
+	s.tabStyle = tabStyle
+}
+
+// SetMultiLineMode sets whether the edited text may span several lines. In
+// multi-line mode Alt-Enter inserts a newline, Up and Down move between the
+// lines (and through history from the first and last one), and the text is
+// drawn over as many terminal rows as needed instead of scrolling.
+func (s *commonState) SetMultiLineMode(mlmode bool) {
+	s.multiLineMode = mlmode
+}
+
+// SetSoftWrap sets whether a line wider than the terminal wraps onto the rows
+// below, instead of scrolling sideways between '{' and '}' markers. Multi-line
+// mode always wraps.
+func (s *commonState) SetSoftWrap(wrap bool) {
+	s.softWrap = wrap
+}
+
+// SetNewlineKey sets a control key that inserts a newline in multi-line mode,
+// in addition to Alt-Enter. For example, '\n' is Ctrl-J. The default, 0, sets
+// no extra key.
+func (s *commonState) SetNewlineKey(key rune) {
+	s.newlineKey = key
+}
+
+// SetViMode sets whether the prompt uses vi style editing. Each prompt starts
+// in insert mode, where the usual Emacs style keys work, and Esc switches to
+// normal mode for vi motions and commands.
+func (s *commonState) SetViMode(on bool) {
+	s.viMode = on
+}
+
+// SetValidator sets the function that checks the line before Enter accepts it.
+// A nil Validator accepts any line.
+func (s *commonState) SetValidator(f Validator) {
+	s.validator = f
+}
+
+// SetLiveValidation sets whether the Validator also runs after every change,
+// drawing the input in red while it is not valid.
+func (s *commonState) SetLiveValidation(live bool) {
+	s.liveValidation = live
+}
+
+// SetMaxLength sets the largest number of runes the user can type into the
+// line. Keys and yanked text that would go past it are refused with a beep. 0
+// means no limit.
+func (s *commonState) SetMaxLength(n int) {
+	s.maxLength = n
+}
+
+// SetMaxWidth is like SetMaxLength, but limits the width of the line on the
+// terminal, where wide runes take two columns and combining runes none.
+func (s *commonState) SetMaxWidth(n int) {
+	s.maxWidth = n
+}
+
+// SetRuneFilter sets a function that tells which runes the user may type into
+// the line. Other runes are refused with a beep, and left out of yanked text.
+// A nil filter allows every rune.
+func (s *commonState) SetRuneFilter(f func(r rune) bool) {
+	s.runeFilter = f
+}
+
+// SetHighlighter sets the function that colors the edited line. It is called
+// each time the line is redrawn, but not for PasswordPrompt.
+func (s *commonState) SetHighlighter(f Highlighter) {
+	s.highlighter = f
+}
+
+// SetAutoSuggester sets the source of the suggestions shown after the cursor
+// when it is at the end of the line. Right or Ctrl-F accepts the whole
+// suggestion, Alt-F its next word. A nil AutoSuggester shows none.
+func (s *commonState) SetAutoSuggester(f AutoSuggester) {
+	s.autoSuggester = f
+}
+
+// SetPasteMode sets what happens to the newlines in pasted text. Pasted text
+// is told apart from typed keys when the terminal supports bracketed paste,
+// and is inserted as it is, without running any editing command.
+func (s *commonState) SetPasteMode(mode PasteMode) {
+	s.pasteMode = mode
+}
+
+// Bind makes key run cmd, one of the EditCommands or an EditFunc, instead of
+// what it does by default. Binding a nil Command restores the default. Keys
+// are not looked up in vi normal mode.
+func (s *commonState) Bind(key Key, cmd Command) {
+	if cmd == nil {
+		delete(s.bindings, key)
+		return
+	}
+	if s.bindings == nil {
+		s.bindings = make(map[Key]Command)
+	}
+	s.bindings[key] = cmd
+}
+
+// AppendHistory appends an entry to the scrollback history. AppendHistory
+// should be called iff Prompt returns a valid command.
+func (s *commonState) AppendHistory(item string) {
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	if len(s.history) > 0 {
+		if item == s.history[len(s.history)-1] {
+			return
+		}
+	}
+	s.history = append(s.history, item)
+	if len(s.history) > HistoryLimit {
+		s.history = s.history[1:]
+	}
+}
 
+// ClearHistory clears the scrollback history.
+func (s *commonState) ClearHistory() {
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+	s.history = nil
+}
+
+// historyEscaper and historyUnescaper convert entries to and from the history
+// file format: one entry per line, with backslash, newline and carriage return
+// written as \\, \n and \r.
+var (
+	historyEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+	historyUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+)
+
+// ReadHistory reads scrollback history from r. Returns the number of lines
+// read, and any read error (except io.EOF).
+func (s *commonState) ReadHistory(r io.Reader) (num int, err error) {
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	in := bufio.NewReaderSize(r, HistoryLineMax)
+	for {
+		line, part, err := in.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return num, err
+		}
+		if part {
+			return num, fmt.Errorf("line %d is too long", num+1)
+		}
+		if !utf8.Valid(line) {
+			return num, fmt.Errorf("invalid string at line %d", num+1)
+		}
+		num++
+		s.history = append(s.history, historyUnescaper.Replace(string(line)))
+		if len(s.history) > HistoryLimit {
+			s.history = s.history[1:]
+		}
+	}
+	return num, nil
+}
+
+// WriteHistory writes scrollback history to w. Returns the number of lines
+// successfully written, and any write error. Entries too long for ReadHistory
+// once escaped are left out.
+//
+// WriteHistory is safe to call from another goroutine while a prompt is in
+// progress, so the history can be saved during an unexpected exit.
+func (s *commonState) WriteHistory(w io.Writer) (num int, err error) {
+	s.historyMutex.RLock()
+	defer s.historyMutex.RUnlock()
+
+	for _, item := range s.history {
+		line := historyEscaper.Replace(item)
+		if len(line) >= HistoryLineMax {
+			// With its newline, the line would not fit ReadHistory's buffer
+			continue
+		}
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return num, err
+		}
+		num++
+	}
+	return num, nil
+}
+
+// HistoryAutoSuggestion is an AutoSuggester that suggests the most recent
+// history entry starting with line.
+func (s *commonState) HistoryAutoSuggestion(line string) string {
+	s.historyMutex.RLock()
+	defer s.historyMutex.RUnlock()
+
+	for i := len(s.history) - 1; i >= 0; i-- {
+		if len(s.history[i]) > len(line) && strings.HasPrefix(s.history[i], line) {
+			return s.history[i]
+		}
+	}
+	return ""
+}
+
+// getHistoryByPrefix returns the history entries starting with prefix, oldest
+// first.
+func (s *commonState) getHistoryByPrefix(prefix string) (ph []string) {
+	s.historyMutex.RLock()
+	defer s.historyMutex.RUnlock()
+
+	for _, h := range s.history {
+		if strings.HasPrefix(h, prefix) {
+			ph = append(ph, h)
+		}
+	}
+	return
+}
+
+// getHistoryByPattern returns the history entries containing pattern, oldest
+// first, along with the rune position of the match in every entry.
+func (s *commonState) getHistoryByPattern(pattern string) (ph []string, pos []int) {
+	if pattern == "" {
+		return
+	}
+
+	s.historyMutex.RLock()
+	defer s.historyMutex.RUnlock()
+
+	for _, h := range s.history {
+		if i := strings.Index(h, pattern); i >= 0 {
+			ph = append(ph, h)
+			pos = append(pos, utf8.RuneCountInString(h[:i]))
+		}
+	}
+	return
+}
+
+// longestCommonPrefix returns the longest string all of strs start with.
+func longestCommonPrefix(strs []string) string {
+	if len(strs) == 0 {
+		return ""
+	}
+	longest := []rune(strs[0])
+	for _, str := range strs[1:] {
+		r := []rune(str)
+		if len(r) < len(longest) {
+			longest = longest[:len(r)]
+		}
+		for i := range longest {
+			if longest[i] != r[i] {
+				longest = longest[:i]
+				break
+			}
+		}
+	}
+	return string(longest)
+}
 
 func (s *State) promptUnsupported(p string) (string, error) {
 	// TODO: check what this actually do
 	if !s.inputRedirected || !s.terminalSupported {
-		fmt.Print(p)
+		fmt.Fprint(s.out, p)
 	}
 	linebuf, _, err := s.r.ReadLine()
 	if err != nil {
@@ -0,0 +1,47 @@
+package liner
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistoryRoundTrip(t *testing.T) {
+	var s commonState
+	entries := []string{
+		"first",
+		"two\nlines",
+		`back\slash`,
+		strings.Repeat("x", HistoryLineMax),
+		strings.Repeat("\n", HistoryLineMax/2),
+		strings.Repeat("y", HistoryLineMax-1),
+		"last",
+	}
+	for _, e := range entries {
+		s.AppendHistory(e)
+	}
+
+	var buf bytes.Buffer
+	num, err := s.WriteHistory(&buf)
+	if err != nil {
+		t.Fatalf("WriteHistory: %v", err)
+	}
+	if num != 5 {
+		t.Errorf("WriteHistory wrote %d entries, want 5", num)
+	}
+
+	var r commonState
+	num, err = r.ReadHistory(&buf)
+	if err != nil {
+		t.Fatalf("ReadHistory: %v", err)
+	}
+	want := []string{entries[0], entries[1], entries[2], entries[5], entries[6]}
+	if num != len(want) {
+		t.Fatalf("ReadHistory read %d entries, want %d", num, len(want))
+	}
+	for i, h := range r.history {
+		if h != want[i] {
+			t.Errorf("entry %d is %q, want %q", i, h, want[i])
+		}
+	}
+}
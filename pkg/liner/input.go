@@ -3,12 +3,16 @@ package liner
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"golang.org/x/sys/unix"
+	"io"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +34,7 @@ const (
 
 type termios struct {
 	unix.Termios
+	fd int
 }
 
 type nexter struct {
@@ -40,12 +45,29 @@ type nexter struct {
 // State represents an open terminal
 type State struct {
 	commonState
-	origMode    termios
-	defaultMode termios
-	next        <-chan nexter
-	winch       chan os.Signal
-	pending     []rune
-	useCHA      bool
+	origMode     termios
+	defaultMode  termios
+	next         <-chan nexter
+	winch        chan os.Signal
+	pending      []rune
+	useCHA       bool
+	reading      bool
+	ctx          context.Context
+	expired      <-chan time.Time
+	printMutex   sync.Mutex
+	prompting    bool
+	callbacks    int
+	printQueue   []printRequest
+	printReady   chan struct{}
+	lastPrompt   []rune
+	lastBuf      []rune
+	lastPos      int
+	noGhost      bool
+	sizeMutex    sync.Mutex
+	fixedColumns int
+	out          io.Writer
+	inFd         int
+	outFd        int
 }
 
 var errTimedOut = errors.New("timeout")
@@ -53,32 +75,62 @@ var errTimedOut = errors.New("timeout")
 // NewLiner initializes a new *State, and sets the terminal into raw mode. To
 // restore the terminal to its previous state, call State.Close().
 func NewLiner() *State {
+	return NewLinerWithIO(os.Stdin, os.Stdout, unix.Stdin, unix.Stdout)
+}
+
+// NewLinerWithIO is like NewLiner, but reads keys from in and writes to out
+// instead of the standard streams, for example to drive a pty or an SSH
+// channel. The terminal mode is read from and set on inFd, and the window size
+// is read from outFd.
+//
+// Pass -1 for a descriptor that is not available, as for an SSH channel. The
+// stream is then taken for a terminal all the same: with an inFd of -1, in must
+// deliver keys as a terminal in raw mode does, without echoing them; with an
+// outFd of -1, the width is 80 columns until set with SetColumns.
+func NewLinerWithIO(in io.Reader, out io.Writer, inFd, outFd int) *State {
 	var s State
-	s.r = bufio.NewReader(os.Stdin)
+	s.r = bufio.NewReader(in)
+	s.out = out
+	s.inFd = inFd
+	s.outFd = outFd
+	s.printReady = make(chan struct{}, 1)
+	// Never apply a mode to a descriptor that was not read from
+	s.origMode.fd = inFd
+	s.defaultMode.fd = inFd
+	s.fixedColumns = defaultColumns
 
 	s.terminalSupported = TerminalSupported()
-	if m, err := TerminalMode(); err == nil {
-		s.origMode = *m.(*termios)
-	} else {
-		s.inputRedirected = true
+	if inFd >= 0 {
+		if m, err := getMode(inFd); err == nil {
+			s.origMode = *m
+		} else {
+			s.inputRedirected = true
+		}
 	}
-	if _, err := getMode(unix.Stdout); err != nil {
-		s.outputRedirected = true
+	if outFd >= 0 {
+		if _, err := getMode(outFd); err != nil {
+			s.outputRedirected = true
+		}
 	}
 	if s.inputRedirected && s.outputRedirected {
 		s.terminalSupported = false
 	}
 	if s.terminalSupported && !s.inputRedirected && !s.outputRedirected {
-		mode := s.origMode
-		mode.Iflag &^= internal.Icrnl | internal.Inpck | internal.Istrip | internal.Ixon
-		mode.Cflag |= internal.Cs8
-		mode.Lflag &^= unix.ECHO | internal.Icanon | internal.Iexten
-		mode.Cc[unix.VMIN] = 1
-		mode.Cc[unix.VTIME] = 0
-		mode.ApplyMode()
+		if inFd >= 0 {
+			mode := s.origMode
+			mode.Iflag &^= icrnl | inpck | istrip | ixon
+			mode.Cflag |= cs8
+			mode.Lflag &^= unix.ECHO | icanon | iexten
+			mode.Cc[unix.VMIN] = 1
+			mode.Cc[unix.VTIME] = 0
+			mode.ApplyMode()
+		}
 
+		// SetColumns reports resizes through winch as well
 		winch := make(chan os.Signal, 1)
-		signal.Notify(winch, unix.SIGWINCH)
+		if outFd >= 0 {
+			signal.Notify(winch, unix.SIGWINCH)
+		}
 		s.winch = winch
 
 		s.checkOutput()
@@ -114,23 +166,29 @@ func (s *State) Close() error {
 
 func (s *State) startPrompt() {
 	if s.terminalSupported {
-		if m, err := TerminalMode(); err == nil {
-			s.defaultMode = *m.(*termios)
+		if m, err := getMode(s.inFd); err == nil {
+			s.defaultMode = *m
 			mode := s.defaultMode
 			mode.Lflag &^= isig
 			mode.ApplyMode()
 		}
+		fmt.Fprint(s.out, pasteOn)
 	}
 	s.restartPrompt()
 }
 
 func (s *State) stopPrompt() {
 	if s.terminalSupported {
+		fmt.Fprint(s.out, pasteOff)
 		s.defaultMode.ApplyMode()
 	}
 }
 
 func (s *State) restartPrompt() {
+	if s.reading {
+		// A cancelled prompt left its rune reader running, keep using it
+		return
+	}
 	next := make(chan nexter, 200)
 	go func() {
 		for {
@@ -138,13 +196,64 @@ func (s *State) restartPrompt() {
 			n.r, _, n.err = s.r.ReadRune()
 			next <- n
 			// Shut down nexter loop when an end condition has been reached
-			if n.err != nil || n.r == '\n' || n.r == '\r' {
+			if n.last() {
 				close(next)
 				return
 			}
 		}
 	}()
 	s.next = next
+	s.reading = true
+}
+
+// last reports whether the rune reader shuts down after n.
+func (n nexter) last() bool {
+	return n.err != nil || n.r == '\n' || n.r == '\r' || n.r == ctrlC || n.r == ctrlD
+}
+
+// nextRune waits for the next rune from the rune reader. While it waits, it
+// prints what Write queued, and returns winch if the terminal is resized.
+func (s *State) nextRune() (interface{}, error) {
+	var done <-chan struct{}
+	if s.ctx != nil {
+		done = s.ctx.Done()
+	}
+	var idle <-chan time.Time
+	if s.idleTimeout > 0 {
+		idle = time.After(s.idleTimeout)
+	}
+	for {
+		select {
+		case thing, ok := <-s.next:
+			if !ok {
+				s.reading = false
+				// TODO: once i undertand the code more, i should update the error
+				// whay return 0 instead of nil?
+				return 0, ErrTemporary
+			}
+			if thing.last() {
+				s.reading = false
+			}
+			if thing.err != nil {
+				return nil, thing.err
+			}
+			return thing.r, nil
+		case <-s.winch:
+			columns := s.columns
+			s.getColumns()
+			s.rewrap(columns)
+			return winch, nil
+		case <-done:
+			return nil, s.ctx.Err()
+		case <-s.expired:
+			return nil, ErrPromptTimeout
+		case <-idle:
+			return nil, ErrPromptTimeout
+		case <-s.printReady:
+			// Not a key, keep waiting for one
+			s.printQueued()
+		}
+	}
 }
 
 func (s *State) readNext() (interface{}, error) {
@@ -153,22 +262,11 @@ func (s *State) readNext() (interface{}, error) {
 		s.pending = s.pending[1:]
 		return rv, nil
 	}
-	var r rune
-	select {
-	case thing, ok := <-s.next:
-		if !ok {
-			// TODO: once i undertand the code more, i should update the error
-			// whay return 0 instead of nil?
-			return 0, ErrTemporary
-		}
-		if thing.err != nil {
-			return nil, thing.err
-		}
-		r = thing.r
-	case <-s.winch:
-		s.getColumns()
-		return winch, nil
+	next, err := s.nextRune()
+	if err != nil || next == winch {
+		return next, err
 	}
+	r := next.(rune)
 	if r != esc {
 		return r, nil
 	}
@@ -306,6 +404,12 @@ func (s *State) readNext() (interface{}, error) {
 						return f11, nil
 					case 24:
 						return f12, nil
+					case pasteStart:
+						p, err := s.readPaste()
+						if err != nil {
+							return nil, err
+						}
+						return p, nil
 					default:
 						return unknown, nil
 					}
@@ -359,9 +463,15 @@ func (s *State) readNext() (interface{}, error) {
 	case 'f':
 		s.pending = s.pending[:0] // escape code complete
 		return altF, nil
+	case 'r':
+		s.pending = s.pending[:0] // escape code complete
+		return altR, nil
 	case 'y':
 		s.pending = s.pending[:0] // escape code complete
 		return altY, nil
+	case cr, lf:
+		s.pending = s.pending[:0] // escape code complete
+		return altEnter, nil
 	default:
 		rv := s.pending[0]
 		s.pending = s.pending[1:]
@@ -376,8 +486,12 @@ func (s *State) nextPending(timeout <-chan time.Time) (rune, error) {
 	select {
 	case thing, ok := <-s.next:
 		if !ok {
+			s.reading = false
 			return 0, ErrTemporary
 		}
+		if thing.last() {
+			s.reading = false
+		}
 		if thing.err != nil {
 			return 0, thing.err
 		}
@@ -0,0 +1,203 @@
+package liner
+
+// Key is a key press that Bind can attach a command to. Printable keys and
+// control keys are their rune, for example Key('a') or KeyCtrlO. Keys that
+// send an escape sequence have their own negative values.
+type Key rune
+
+// Control keys. Tab, Enter and Backspace have their own names as well.
+const (
+	KeyCtrlA Key = ctrlA + iota
+	KeyCtrlB
+	KeyCtrlC
+	KeyCtrlD
+	KeyCtrlE
+	KeyCtrlF
+	KeyCtrlG
+	KeyCtrlH
+	KeyCtrlI
+	KeyCtrlJ
+	KeyCtrlK
+	KeyCtrlL
+	KeyCtrlM
+	KeyCtrlN
+	KeyCtrlO
+	KeyCtrlP
+	KeyCtrlQ
+	KeyCtrlR
+	KeyCtrlS
+	KeyCtrlT
+	KeyCtrlU
+	KeyCtrlV
+	KeyCtrlW
+	KeyCtrlX
+	KeyCtrlY
+	KeyCtrlZ
+	KeyEsc
+
+	KeyCtrlUnderscore = Key(ctrlUnderscore)
+
+	KeyTab       = KeyCtrlI
+	KeyEnter     = KeyCtrlM
+	KeyBackspace = Key(bs)
+)
+
+// Keys that send an escape sequence.
+const (
+	KeyLeft         = -1 - Key(left)
+	KeyRight        = -1 - Key(right)
+	KeyUp           = -1 - Key(up)
+	KeyDown         = -1 - Key(down)
+	KeyHome         = -1 - Key(home)
+	KeyEnd          = -1 - Key(end)
+	KeyInsert       = -1 - Key(insert)
+	KeyDelete       = -1 - Key(del)
+	KeyPageUp       = -1 - Key(pageUp)
+	KeyPageDown     = -1 - Key(pageDown)
+	KeyF1           = -1 - Key(f1)
+	KeyF2           = -1 - Key(f2)
+	KeyF3           = -1 - Key(f3)
+	KeyF4           = -1 - Key(f4)
+	KeyF5           = -1 - Key(f5)
+	KeyF6           = -1 - Key(f6)
+	KeyF7           = -1 - Key(f7)
+	KeyF8           = -1 - Key(f8)
+	KeyF9           = -1 - Key(f9)
+	KeyF10          = -1 - Key(f10)
+	KeyF11          = -1 - Key(f11)
+	KeyF12          = -1 - Key(f12)
+	KeyAltB         = -1 - Key(altB)
+	KeyAltBackspace = -1 - Key(altBs)
+	KeyAltD         = -1 - Key(altD)
+	KeyAltF         = -1 - Key(altF)
+	KeyAltR         = -1 - Key(altR)
+	KeyAltY         = -1 - Key(altY)
+	KeyAltEnter     = -1 - Key(altEnter)
+	KeyShiftTab     = -1 - Key(shiftTab)
+	KeyCtrlLeft     = -1 - Key(wordLeft)
+	KeyCtrlRight    = -1 - Key(wordRight)
+)
+
+// keyOf returns the Key of a rune or action returned by readNext.
+func keyOf(next interface{}) Key {
+	switch k := next.(type) {
+	case rune:
+		return Key(k)
+	case action:
+		return -1 - Key(k)
+	}
+	return -1 - Key(unknown)
+}
+
+// Command is something Bind can attach to a key: one of the named
+// EditCommands, or an EditFunc.
+type Command interface {
+	isCommand()
+}
+
+// EditCommand is one of the built in editing commands.
+type EditCommand int
+
+// Built in editing commands, with the keys they are bound to by default.
+const (
+	BeginningOfLine      EditCommand = iota // Ctrl-A, Home
+	EndOfLine                               // Ctrl-E, End
+	BackwardChar                            // Ctrl-B, Left
+	ForwardChar                             // Ctrl-F, Right
+	BackwardWord                            // Alt-B, Ctrl-Left
+	ForwardWord                             // Alt-F, Ctrl-Right
+	DeleteChar                              // Del
+	BackwardDeleteChar                      // Ctrl-H, Backspace
+	KillLine                                // Ctrl-K
+	BackwardKillLine                        // Ctrl-U
+	KillWord                                // Alt-D
+	BackwardKillWord                        // Ctrl-W, Alt-Backspace
+	Yank                                    // Ctrl-Y
+	TransposeChars                          // Ctrl-T
+	ClearScreen                             // Ctrl-L
+	PreviousHistory                         // Ctrl-P, Up
+	NextHistory                             // Ctrl-N, Down
+	ReverseSearchHistory                    // Ctrl-R
+	ForwardSearchHistory                    // Ctrl-S
+	Complete                                // Tab
+	AcceptLine                              // Enter
+	InsertNewline                           // Alt-Enter
+	Interrupt                               // Ctrl-C
+	Undo                                    // Ctrl-_, Ctrl-X Ctrl-U
+	Redo                                    // Ctrl-X Ctrl-R
+	RevertLine                              // Alt-R, back to the suggestion
+	Ignore                                  // does nothing, quietly
+)
+
+// commandKeys holds the key each EditCommand is handled as in the editing
+// loop.
+var commandKeys = [...]interface{}{
+	BeginningOfLine:      rune(ctrlA),
+	EndOfLine:            rune(ctrlE),
+	BackwardChar:         left,
+	ForwardChar:          right,
+	BackwardWord:         altB,
+	ForwardWord:          altF,
+	DeleteChar:           del,
+	BackwardDeleteChar:   rune(bs),
+	KillLine:             rune(ctrlK),
+	BackwardKillLine:     rune(ctrlU),
+	KillWord:             altD,
+	BackwardKillWord:     rune(ctrlW),
+	Yank:                 rune(ctrlY),
+	TransposeChars:       rune(ctrlT),
+	ClearScreen:          rune(ctrlL),
+	PreviousHistory:      up,
+	NextHistory:          down,
+	ReverseSearchHistory: rune(ctrlR),
+	ForwardSearchHistory: rune(ctrlS),
+	Complete:             rune(tab),
+	AcceptLine:           rune(cr),
+	InsertNewline:        altEnter,
+	Interrupt:            rune(ctrlC),
+	Undo:                 undo,
+	Redo:                 redo,
+	RevertLine:           altR,
+	Ignore:               unknown,
+}
+
+func (EditCommand) isCommand() {}
+
+// EditFunc is a custom command. It gets the edited line and the cursor
+// position, and returns the new line and cursor position. The line passed in
+// is a copy, it may be modified and returned.
+type EditFunc func(line []rune, pos int) ([]rune, int)
+
+func (EditFunc) isCommand() {}
+
+// bound looks up the command bound to next, and runs it if it is an EditFunc.
+// It returns the key the editing loop should handle next, which is unknown
+// after an EditFunc.
+func (s *State) bound(next interface{}, line []rune, pos int) (interface{}, []rune, int) {
+	cmd, ok := s.bindings[keyOf(next)]
+	if !ok {
+		return next, line, pos
+	}
+	if r, ok := next.(rune); ok && (r == cr || r == lf || r == ctrlC || r == ctrlD) &&
+		cmd != AcceptLine && cmd != Interrupt {
+		// The rune reader stops after these keys, make it carry on
+		s.restartPrompt()
+	}
+	switch cmd := cmd.(type) {
+	case EditCommand:
+		if int(cmd) < 0 || int(cmd) >= len(commandKeys) {
+			return unknown, line, pos
+		}
+		return commandKeys[cmd], line, pos
+	case EditFunc:
+		s.callback(func() { line, pos = cmd(append([]rune{}, line...), pos) })
+		if pos < 0 {
+			pos = 0
+		}
+		if pos > len(line) {
+			pos = len(line)
+		}
+		return unknown, line, pos
+	}
+	return next, line, pos
+}
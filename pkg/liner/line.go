@@ -1,12 +1,14 @@
 package liner
 
 import (
-	"bufio"
 	"container/ring"
+	"context"
 	"fmt"
 	"io"
-	"os"
+	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 type action int
@@ -39,9 +41,13 @@ const (
 	altD
 	altF
 	altY
+	altEnter
 	shiftTab
 	wordLeft
 	wordRight
+	altR
+	undo
+	redo
 	winch
 	unknown
 )
@@ -74,29 +80,70 @@ const (
 	ctrlY = 25
 	ctrlZ = 26
 	esc   = 27
-	bs    = 127
+
+	ctrlUnderscore = 31
+
+	bs = 127
 )
 
 const (
 	beep = "\a"
 )
 
-//WARN: the prompt string cant have \n has to fix that
-// is a valid reason, maybe discard the prompt part and only dealth with the input field
+// Prompt displays p and returns a line of user input, not including a trailing
+// newline character. An io.EOF error is returned if the user signals end-of-file
+// by pressing Ctrl-D.
+func (s *State) Prompt(prompt string) (string, error) {
+	return s.PromptWithSuggestion(prompt, "", -1)
+}
+
+// splitPrompt checks prompt for unprintable runes, and splits it into the
+// header, every line but the last one, and the last line. Only the last line
+// is redrawn while editing, the header is printed once. SGR sequences and
+// OSC 8 hyperlinks are allowed, any other control rune is not.
+func splitPrompt(prompt string) (string, []rune, error) {
+	r := []rune(prompt)
+	for i := 0; i < len(r); i++ {
+		if n := escapeLen(r[i:]); n > 0 {
+			i += n - 1
+			continue
+		}
+		if r[i] != '\n' && unicode.Is(unicode.C, r[i]) {
+			return "", nil, ErrInvalidPrompt
+		}
+	}
+	i := strings.LastIndexByte(prompt, '\n')
+	return prompt[:i+1], []rune(prompt[i+1:]), nil
+}
+
+// PromptContext is like Prompt, but gives up when ctx is done. See
+// PromptWithSuggestionContext.
+func (s *State) PromptContext(ctx context.Context, prompt string) (string, error) {
+	return s.PromptWithSuggestionContext(ctx, prompt, "", -1)
+}
 
 // PromptWithSuggestion displays prompt and an editable text with cursor at
 // given position. The cursor will be set to the end of the line if given position
 // is negative or greater than length of text (in runes). Returns a line of user input, not
 // including a trailing newline character.
+// The prompt may span several lines, only its last line shares the row with the
+// edited text.
 func (s *State) PromptWithSuggestion(prompt string, text string, pos int) (string, error) {
+	return s.PromptWithSuggestionContext(context.Background(), prompt, text, pos)
+}
+
+// PromptWithSuggestionContext is like PromptWithSuggestion, but gives up when
+// ctx is done, for example to abort the prompt from another goroutine. The
+// partially edited line is erased, the terminal mode restored, and ctx.Err()
+// returned.
+func (s *State) PromptWithSuggestionContext(ctx context.Context, prompt string, text string, pos int) (string, error) {
 	if s.outputRedirected {
 		return "", ErrNotTerminalOutput
 	}
 
-	for _, r := range prompt {
-		if unicode.Is(unicode.C, r) {
-			return "", ErrInvalidPrompt
-		}
+	header, p, err := splitPrompt(prompt)
+	if err != nil {
+		return "", err
 	}
 
 	// WARN: check this, i do not understand why is here, what it do
@@ -104,25 +151,52 @@ func (s *State) PromptWithSuggestion(prompt string, text string, pos int) (strin
 		return s.promptUnsupported(prompt)
 	}
 
-	p := []rune(prompt)
 	// TODO: why do i have this here?
 	const minWorkingSpace = 10
 	if s.columns < countGlyphs(p)+minWorkingSpace {
 		return s.tooNarrow(prompt)
 	}
 
+	s.ctx = ctx
+	defer func() { s.ctx = nil }()
+	s.styling = true
+	defer func() { s.styling = false }()
+	s.startDeadline()
+	defer s.stopDeadline()
+
+	s.startPrinting()
+	defer s.stopPrinting()
+
 	// TODO: once it works, get ride of the part that shows the prompt
-	fmt.Print(prompt)
+	fmt.Fprint(s.out, prompt)
 
 	var line = []rune(text)
 	// NOTE: do i use this?
 	killAction := 0 // used to mark kill related actions
 
+	// mode for prefix-based history navigation
+	var historyEnd string
+	var historyPrefix []string
+	historyPos := 0
+	historyStale := true
+	historyAction := false // used to mark history related actions
+
+	var vi viState // vi mode state, starting in insert mode
+	var edits undoState
+	timedOut := false // whether the deadline submitted the line
+	s.message = ""
+	s.invalid = false
+
 	defer s.stopPrompt()
 
 	if pos < 0 || len(line) < pos {
 		pos = len(line)
 	}
+	origPos := pos // for reverting the line
+	if s.liveValidation && s.validator != nil {
+		s.invalid = s.validate(text) != nil
+	}
+	s.remember(p, line, pos)
 	if len(line) > 0 {
 		err := s.refresh(p, line, pos)
 		if err != nil {
@@ -137,31 +211,93 @@ restart:
 mainLoop:
 	for {
 		next, err := s.readNext()
+		edits.mark(line, pos)
+		if s.message != "" {
+			// The validation error is shown until the next key
+			s.message = ""
+			s.needRefresh = true
+		}
+		typed := false // whether the key is typed into the line
 	haveNext:
 		if err != nil {
+			if err == ctx.Err() {
+				s.eraseInput()
+				return "", err
+			}
+			if err == ErrPromptTimeout {
+				if s.timeoutSubmits {
+					next, err = rune(cr), nil
+					timedOut = true
+					goto dispatch
+				}
+				s.drawFinal(p, line, pos, false)
+				s.moveToLastRow()
+				fmt.Fprintln(s.out)
+				return "", err
+			}
 			if s.shouldRestart != nil && s.shouldRestart(err) {
 				goto restart
 			}
+			s.drawFinal(p, line, pos, false)
 			return "", err
 		}
 
+		if !vi.normal {
+			next, line, pos = s.bound(next, line, pos)
+		}
+		if s.viMode {
+			if vi.normal {
+				var pass interface{}
+				line, pos, pass, err = s.viNormal(&vi, line, pos, next)
+				if err != nil {
+					goto haveNext
+				}
+				if pass == nil {
+					pass = unknown
+				}
+				next = pass
+				// A change that enters insert mode is undone with the typing after it
+				typed = !vi.normal
+			} else {
+				vi.record(next)
+			}
+		}
+
+	dispatch:
 		switch v := next.(type) {
 		case rune:
+			if s.multiLineMode && s.newlineKey != 0 && v == s.newlineKey {
+				next = altEnter
+				goto dispatch
+			}
 			switch v {
 			case cr, lf:
-				if s.needRefresh {
-					err := s.refresh(p, line, pos)
-					if err != nil {
-						return "", err
+				if s.validator != nil {
+					if err := s.validate(string(line)); err != nil {
+						if timedOut {
+							s.moveToLastRow()
+							fmt.Fprintln(s.out)
+							return "", ErrPromptTimeout
+						}
+						s.message = err.Error()
+						s.doBeep()
+						s.restartPrompt()
+						s.needRefresh = true
+						break
 					}
+					s.invalid = false
+				}
+				if err := s.drawFinal(p, line, pos, s.needRefresh); err != nil {
+					return "", err
 				}
-				fmt.Println()
+				s.moveToLastRow()
+				fmt.Fprintln(s.out)
 				break mainLoop
 			case ctrlA: // Start of line
-				pos = 0
+				pos, _ = rowBounds(line, pos)
 				s.needRefresh = true
 			case ctrlE: // End of line
-				pos = len(line)
+				_, pos = rowBounds(line, pos)
 				s.needRefresh = true
 			case ctrlB: // left
 				if pos > 0 {
@@ -174,6 +310,10 @@ mainLoop:
 				if pos < len(line) {
 					pos += len(getPrefixGlyphs(line[pos:], 1))
 					s.needRefresh = true
+				} else if ghost := s.autoSuggestion(line, len(line)); ghost != nil {
+					line = s.acceptGhost(line, ghost, false)
+					pos = len(line)
+					s.needRefresh = true
 				} else {
 					s.doBeep()
 				}
@@ -226,15 +366,24 @@ mainLoop:
 				}
 			case ctrlL: // clear screen
 				s.eraseScreen()
+				fmt.Fprint(s.out, header)
 				s.needRefresh = true
 			case ctrlC: // reset
-				fmt.Println("^C")
+				if err := s.drawFinal(p, line, pos, false); err != nil {
+					return "", err
+				}
+				s.moveToLastRow()
+				fmt.Fprintln(s.out, "^C")
 				if s.ctrlCAborts {
 					return "", ErrPromptAborted
 				}
 				line = line[:0]
 				pos = 0
-				fmt.Print(prompt)
+				vi.normal = false
+				edits.reset()
+				s.invalid = false
+				fmt.Fprint(s.out, prompt)
+				s.remember(p, line, pos)
 				s.restartPrompt()
 			case ctrlH, bs: // Backspace
 				if pos <= 0 {
@@ -260,23 +409,78 @@ mainLoop:
 				pos, line, killAction = s.eraseWord(pos, line, killAction)
 			case ctrlY: // Paste from Yank buffer
 				line, pos, next, err = s.yank(p, line, pos)
+				edits.split(line, pos)
 				goto haveNext
+			case tab: // Tab completion
+				line, pos, next, err = s.tabComplete(p, line, pos)
+				s.needRefresh = true
+				edits.split(line, pos)
+				goto haveNext
+			case ctrlR: // Reverse search
+				line, pos, next, err = s.iSearch(line, pos, true)
+				s.needRefresh = true
+				edits.split(line, pos)
+				goto haveNext
+			case ctrlS: // Forward search
+				line, pos, next, err = s.iSearch(line, pos, false)
+				s.needRefresh = true
+				edits.split(line, pos)
+				goto haveNext
+			case ctrlP: // up
+				next = up
+				goto dispatch
+			case ctrlN: // down
+				next = down
+				goto dispatch
+			case ctrlUnderscore: // Undo
+				next = undo
+				goto dispatch
+			case ctrlX: // Prefix of Ctrl-X Ctrl-U (undo) and Ctrl-X Ctrl-R (redo)
+				next, err = s.readNext()
+				if err != nil {
+					goto haveNext
+				}
+				switch next {
+				case rune(ctrlU):
+					next = undo
+				case rune(ctrlR):
+					next = redo
+				default:
+					s.doBeep()
+					s.restartPrompt()
+					next = unknown
+				}
+				goto dispatch
 			// Catch keys that do nothing, but you don't want them to beep
 			case esc:
-				// DO NOTHING
+				if s.viMode {
+					// Switch to normal mode, with the cursor on the last inserted rune
+					vi.normal = true
+					vi.recording = false
+					if start, _ := rowBounds(line, pos); pos > start {
+						pos--
+					}
+					s.needRefresh = true
+				}
 			// Unused keys
-			case ctrlG, ctrlO, ctrlQ, ctrlS, ctrlV, ctrlX, ctrlZ:
+			case ctrlG, ctrlO, ctrlQ, ctrlV, ctrlZ:
 				fallthrough
 			// Catch unhandled control codes (anything <= 31)
-			case 0, 28, 29, 30, 31:
+			case 0, 28, 29, 30:
 				s.doBeep()
 			default:
-				if pos == len(line) &&
+				if add, _ := s.constrain(line, []rune{v}); len(add) == 0 {
+					s.doBeep()
+					break
+				}
+				typed = true
+				if pos == len(line) && !s.liveValidation && s.highlighter == nil && s.autoSuggester == nil &&
 					len(p)+len(line) < s.columns*4 && // Avoid countGlyphs on large lines
 					countGlyphs(p)+countGlyphs(line) < s.columns-1 {
 					line = append(line, v)
-					fmt.Printf("%c", v)
+					fmt.Fprintf(s.out, "%c", v)
 					pos++
+					s.remember(p, line, pos)
 				} else {
 					line = append(line[:pos], append([]rune{v}, line[pos:]...)...)
 					pos++
@@ -322,11 +526,17 @@ mainLoop:
 			case right:
 				if pos < len(line) {
 					pos += len(getPrefixGlyphs(line[pos:], 1))
+				} else if ghost := s.autoSuggestion(line, len(line)); ghost != nil {
+					line = s.acceptGhost(line, ghost, false)
+					pos = len(line)
 				} else {
 					s.doBeep()
 				}
 			case wordRight, altF:
-				if pos < len(line) {
+				if ghost := s.autoSuggestion(line, pos); ghost != nil {
+					line = s.acceptGhost(line, ghost, true)
+					pos = len(line)
+				} else if pos < len(line) {
 					var spaceHere, spaceLeft, hereKnown bool
 					for {
 						pos++
@@ -346,10 +556,70 @@ mainLoop:
 				} else {
 					s.doBeep()
 				}
+			case up:
+				if start, _ := rowBounds(line, pos); start > 0 {
+					// Move to the previous row of a multi-line buffer
+					prevStart, _ := rowBounds(line, start-1)
+					pos = sameColumn(p, line, pos, prevStart)
+					break
+				}
+				historyAction = true
+				if historyStale {
+					historyPrefix = s.getHistoryByPrefix(string(line))
+					historyPos = len(historyPrefix)
+					historyStale = false
+				}
+				if historyPos > 0 {
+					if historyPos == len(historyPrefix) {
+						// Keep the line being edited, to get back to it
+						historyEnd = string(line)
+					}
+					historyPos--
+					line = []rune(historyPrefix[historyPos])
+					pos = len(line)
+				} else {
+					s.doBeep()
+				}
+			case down:
+				if _, end := rowBounds(line, pos); end < len(line) {
+					// Move to the next row of a multi-line buffer
+					pos = sameColumn(p, line, pos, end+1)
+					break
+				}
+				historyAction = true
+				if historyStale {
+					historyPrefix = s.getHistoryByPrefix(string(line))
+					historyPos = len(historyPrefix)
+					historyStale = false
+				}
+				if historyPos < len(historyPrefix) {
+					historyPos++
+					if historyPos == len(historyPrefix) {
+						line = []rune(historyEnd)
+					} else {
+						line = []rune(historyPrefix[historyPos])
+					}
+					pos = len(line)
+				} else {
+					s.doBeep()
+				}
 			case home: // Start of line
-				pos = 0
+				pos, _ = rowBounds(line, pos)
 			case end: // End of line
-				pos = len(line)
+				_, pos = rowBounds(line, pos)
+			case altEnter:
+				// The rune reader shuts down after the carriage return
+				s.restartPrompt()
+				if !s.multiLineMode {
+					next = rune(cr)
+					goto dispatch
+				}
+				if add, _ := s.constrain(line, []rune{'\n'}); len(add) == 0 {
+					s.doBeep()
+					break
+				}
+				line = append(line[:pos], append([]rune{'\n'}, line[pos:]...)...)
+				pos++
 			case altD: // Delete next word
 				if pos == len(line) {
 					s.doBeep()
@@ -381,8 +651,37 @@ mainLoop:
 				killAction = 2 // Mark that there was some killing
 			case altBs: // Erase word
 				pos, line, killAction = s.eraseWord(pos, line, killAction)
+			case undo, redo:
+				var ok bool
+				line, pos, ok = edits.step(line, pos, v == redo)
+				if !ok {
+					s.doBeep()
+				}
+			case altR: // Revert to the suggestion
+				line = []rune(text)
+				pos = origPos
 			}
 			s.needRefresh = true
+		case pasted:
+			text, submit := s.pasteText(v)
+			text, cut := s.constrain(line, text)
+			if cut {
+				s.doBeep()
+			}
+			line = append(line[:pos], append(text, line[pos:]...)...)
+			pos += len(text)
+			s.needRefresh = true
+			if submit {
+				next = rune(cr)
+				goto dispatch
+			}
+		}
+		if vi.normal {
+			pos = viClamp(line, pos)
+		}
+		edits.commit(line, pos, typed)
+		if s.liveValidation && s.validator != nil && s.needRefresh {
+			s.invalid = s.validate(string(line)) != nil
 		}
 		if s.needRefresh && len(s.next) == 0 {
 			err := s.refresh(p, line, pos)
@@ -394,28 +693,205 @@ mainLoop:
 		if killAction > 0 {
 			killAction--
 		}
+		if !historyAction {
+			historyStale = true
+		}
+		historyAction = false
 	}
 	return string(line), nil
 }
 
+// PasswordPrompt displays prompt, and then waits for user input. The input
+// typed by the user is not echoed, unless a mask rune has been set with
+// SetPasswordMask, in which case one mask rune is shown per typed rune.
+// PasswordPrompt never falls back to the echoing dumb terminal read.
+func (s *State) PasswordPrompt(prompt string) (string, error) {
+	if s.outputRedirected {
+		return "", ErrNotTerminalOutput
+	}
+
+	header, p, err := splitPrompt(prompt)
+	if err != nil {
+		return "", err
+	}
+
+	if s.inputRedirected || !s.terminalSupported || s.columns == 0 {
+		return "", ErrPasswordUnsupported
+	}
+
+	const minWorkingSpace = 1
+	if s.columns < countGlyphs(p)+minWorkingSpace {
+		return "", ErrPasswordUnsupported
+	}
+
+	s.startDeadline()
+	defer s.stopDeadline()
+	s.startPrinting()
+	defer s.stopPrinting()
+
+	var line []rune
+	// Wipe the typed runes, whatever way the prompt ends
+	defer func() { zeroRunes(line) }()
+	pos := 0
+
+	defer s.stopPrompt()
+
+restart:
+	s.startPrompt()
+	s.getColumns()
+
+	fmt.Fprint(s.out, prompt)
+	s.remember(p, nil, 0)
+
+mainLoop:
+	for {
+		next, err := s.readNext()
+		if err != nil {
+			if err == ErrPromptTimeout {
+				// Even with SetTimeoutSubmits, a partly typed password is
+				// not worth submitting
+				fmt.Fprintln(s.out)
+				return "", err
+			}
+			if s.shouldRestart != nil && s.shouldRestart(err) {
+				goto restart
+			}
+			return "", err
+		}
+
+		switch v := next.(type) {
+		case rune:
+			switch v {
+			case cr, lf:
+				fmt.Fprintln(s.out)
+				break mainLoop
+			case ctrlD: // del
+				if pos == 0 && len(line) == 0 {
+					// exit
+					return "", io.EOF
+				}
+
+				// ctrlD is a potential EOF, so the rune reader shuts down.
+				// Therefore, if it isn't actually an EOF, we must re-startPrompt.
+				s.restartPrompt()
+			case ctrlL: // clear screen
+				s.eraseScreen()
+				fmt.Fprint(s.out, header)
+				mask := s.maskRunes(len(line))
+				err := s.refresh(p, mask, len(mask))
+				if err != nil {
+					return "", err
+				}
+			case ctrlH, bs: // Backspace
+				if pos <= 0 {
+					s.doBeep()
+				} else {
+					n := len(getSuffixGlyphs(line[:pos], 1))
+					copy(line[pos-n:], line[pos:])
+					zeroRunes(line[len(line)-n:])
+					line = line[:len(line)-n]
+					pos -= n
+					if s.passwordMask != 0 {
+						err := s.refresh(p, s.maskRunes(len(line)), pos)
+						if err != nil {
+							return "", err
+						}
+					}
+				}
+			case ctrlC:
+				fmt.Fprintln(s.out, "^C")
+				if s.ctrlCAborts {
+					return "", ErrPromptAborted
+				}
+				zeroRunes(line)
+				line = line[:0]
+				pos = 0
+				fmt.Fprint(s.out, prompt)
+				s.restartPrompt()
+			// Unused keys
+			case esc, tab, ctrlA, ctrlB, ctrlE, ctrlF, ctrlG, ctrlK, ctrlN, ctrlO, ctrlP, ctrlQ, ctrlR, ctrlS,
+				ctrlT, ctrlU, ctrlV, ctrlW, ctrlX, ctrlY, ctrlZ:
+				fallthrough
+			// Catch unhandled control codes (anything <= 31)
+			case 0, 28, 29, 30, 31:
+				s.doBeep()
+			default:
+				line = appendSecret(line, v)
+				pos++
+				if s.passwordMask != 0 {
+					fmt.Fprintf(s.out, "%c", s.passwordMask)
+				}
+			}
+		case pasted:
+			text, _ := s.pasteText(v)
+			for _, r := range text {
+				if r == '\n' {
+					continue
+				}
+				line = appendSecret(line, r)
+				pos++
+				if s.passwordMask != 0 {
+					fmt.Fprintf(s.out, "%c", s.passwordMask)
+				}
+			}
+			zeroRunes(v)
+			zeroRunes(text)
+		}
+		mask := s.maskRunes(len(line))
+		s.remember(p, mask, len(mask))
+	}
+	return string(line), nil
+}
+
+// appendSecret appends r to the password line. The line is grown by hand, so
+// the old backing array can be wiped.
+func appendSecret(line []rune, r rune) []rune {
+	if len(line) == cap(line) {
+		grown := make([]rune, len(line), 2*cap(line)+16)
+		copy(grown, line)
+		zeroRunes(line)
+		line = grown
+	}
+	return append(line, r)
+}
+
+// maskRunes returns n copies of the password mask rune.
+func (s *State) maskRunes(n int) []rune {
+	if s.passwordMask == 0 {
+		return []rune{}
+	}
+	mask := make([]rune, n)
+	for i := range mask {
+		mask[i] = s.passwordMask
+	}
+	return mask
+}
+
+// zeroRunes overwrites every rune of r, including the unused capacity.
+func zeroRunes(r []rune) {
+	r = r[:cap(r)]
+	for i := range r {
+		r[i] = 0
+	}
+}
+
 func (s *State) tooNarrow(prompt string) (string, error) {
 	// Docker and OpenWRT and etc sometimes return 0 column width
 	// Reset mode temporarily. Restore baked mode in case the terminal
 	// is wide enough for the next Prompt attempt.
-	m, merr := TerminalMode()
+	m, merr := getMode(s.inFd)
 	s.origMode.ApplyMode()
 	if merr == nil {
 		defer m.ApplyMode()
 	}
-	if s.r == nil {
-		// Windows does not always set s.r
-		s.r = bufio.NewReader(os.Stdin)
-		defer func() { s.r = nil }()
-	}
 	return s.promptUnsupported(prompt)
 }
 
 func (s *State) refresh(prompt []rune, buf []rune, pos int) error {
+	s.remember(prompt, buf, pos)
+	if s.multiLineMode || s.softWrap {
+		return s.refreshMultiLine(prompt, buf, pos)
+	}
 	if s.columns == 0 {
 		return ErrZeroColums
 	}
@@ -423,7 +899,12 @@ func (s *State) refresh(prompt []rune, buf []rune, pos int) error {
 	s.needRefresh = false
 
 	s.cursorPos(0)
-	_, err := fmt.Print(string(prompt))
+	if s.maxRows > 1 {
+		// Clear the message row below
+		s.eraseDown()
+		s.maxRows = 0
+	}
+	_, err := fmt.Fprint(s.out, string(prompt))
 	if err != nil {
 		return err
 	}
@@ -434,11 +915,17 @@ func (s *State) refresh(prompt []rune, buf []rune, pos int) error {
 	if cursorColumn {
 		bLen++
 	}
+	ghost := s.autoSuggestion(buf, pos)
 	pos = countGlyphs(buf[:pos])
+	styles := s.styles(buf)
 	if pLen+bLen < s.columns {
-		_, err = fmt.Print(string(buf))
+		_, err = fmt.Fprint(s.out, render(buf, styles, 0, len(buf)))
+		if ghost != nil {
+			fmt.Fprint(s.out, dimmed(ghost, s.columns-pLen-bLen-1))
+		}
 		s.eraseLine()
 		s.cursorPos(pLen + pos)
+		s.showMessage(0, pLen+pos)
 	} else {
 		// Find space available
 		space := s.columns - pLen
@@ -467,23 +954,351 @@ func (s *State) refresh(prompt []rune, buf []rune, pos int) error {
 
 		// Output
 		if start > 0 {
-			fmt.Print("{")
+			fmt.Fprint(s.out, "{")
 		}
-		fmt.Print(string(line))
+		fmt.Fprint(s.out, render(buf, styles, startRune, startRune+len(line)))
 		if end < bLen {
-			fmt.Print("}")
+			fmt.Fprint(s.out, "}")
 		}
 
 		// Set cursor position
 		s.eraseLine()
 		s.cursorPos(pLen + pos)
+		s.showMessage(0, pLen+pos)
 	}
 	return err
 }
 
+// styles returns the escape sequences to draw before each rune of buf, and
+// after the last one: red while live validation finds buf invalid, or the
+// ones added by the Highlighter. It returns nil when buf is drawn plain, which
+// is also the case if the Highlighter changed more than the escape sequences.
+func (s *State) styles(buf []rune) []string {
+	if !s.styling {
+		return nil
+	}
+	if s.invalid {
+		styles := make([]string, len(buf)+1)
+		styles[0] = "\x1b[31m"
+		return styles
+	}
+	if s.highlighter == nil {
+		return nil
+	}
+	var h []rune
+	s.callback(func() { h = []rune(s.highlighter(buf)) })
+	styles := make([]string, len(buf)+1)
+	i := 0
+	for j := 0; j < len(h); j++ {
+		if l := escapeLen(h[j:]); l > 0 {
+			styles[i] += string(h[j : j+l])
+			j += l - 1
+			continue
+		}
+		if i == len(buf) || h[j] != buf[i] {
+			return nil
+		}
+		i++
+	}
+	if i < len(buf) {
+		return nil
+	}
+	return styles
+}
+
+// autoSuggestion returns the rest of the line suggested by the AutoSuggester
+// for line, to be shown after the cursor at pos. It returns nil if there is
+// none, or if the cursor is not at the end of line.
+func (s *State) autoSuggestion(line []rune, pos int) []rune {
+	if s.autoSuggester == nil || !s.styling || s.noGhost || pos != len(line) || len(line) == 0 {
+		return nil
+	}
+	text := string(line)
+	var sug string
+	s.callback(func() { sug = s.autoSuggester(text) })
+	if len(sug) <= len(text) || !strings.HasPrefix(sug, text) {
+		return nil
+	}
+	ghost := []rune(sug[len(text):])
+	for i, r := range ghost {
+		if r < ' ' {
+			// Only show the suggestion up to the end of its first line
+			ghost = ghost[:i]
+			break
+		}
+	}
+	if len(ghost) == 0 {
+		return nil
+	}
+	return ghost
+}
+
+// acceptGhost appends the autosuggestion ghost to line, or only its first
+// word if word is set.
+func (s *State) acceptGhost(line []rune, ghost []rune, word bool) []rune {
+	if word {
+		n := 0
+		for n < len(ghost) && unicode.IsSpace(ghost[n]) {
+			n++
+		}
+		for n < len(ghost) && !unicode.IsSpace(ghost[n]) {
+			n++
+		}
+		ghost = ghost[:n]
+	}
+	ghost, cut := s.constrain(line, ghost)
+	if cut {
+		s.doBeep()
+	}
+	return append(line, ghost...)
+}
+
+// dimmed returns the part of ghost that fits in space glyphs, dimmed.
+func dimmed(ghost []rune, space int) string {
+	if space <= 0 {
+		return ""
+	}
+	return "\x1b[2m" + string(ghost[:columnPos(ghost, space)]) + "\x1b[0m"
+}
+
+// render returns buf[from:to] with its styles. The styles of the runes before
+// from are kept, so that a style started before the visible part still applies.
+func render(buf []rune, styles []string, from, to int) string {
+	if styles == nil {
+		return string(buf[from:to])
+	}
+	var out strings.Builder
+	for i := 0; i < from; i++ {
+		out.WriteString(styles[i])
+	}
+	for i := from; i < to; i++ {
+		out.WriteString(styles[i])
+		out.WriteRune(buf[i])
+	}
+	out.WriteString("\x1b[0m")
+	return out.String()
+}
+
+// showMessage draws the validation error on the row below the input, which
+// ends below rows under the cursor, and puts the cursor back on column col.
+func (s *State) showMessage(below, col int) {
+	if s.message == "" {
+		return
+	}
+	if below > 0 {
+		s.moveDown(below)
+	}
+	fmt.Fprint(s.out, "\n")
+	s.cursorPos(0)
+	fmt.Fprint(s.out, string(getPrefixGlyphs([]rune(s.message), s.columns-1)))
+	s.eraseLine()
+	s.moveUp(below + 1)
+	s.cursorPos(col)
+	s.maxRows = s.cursorRows + below + 2
+}
+
+// refreshMultiLine draws prompt and buf over as many rows as needed: every
+// newline in buf starts a new row, and rows wider than the terminal wrap.
+// s.cursorRows and s.maxRows keep track of the drawn rows, so the next call
+// can go back to the prompt row and clear them.
+func (s *State) refreshMultiLine(prompt []rune, buf []rune, pos int) error {
+	if s.columns == 0 {
+		return ErrZeroColums
+	}
+
+	s.needRefresh = false
+
+	// Go back to the prompt row and clear everything drawn before
+	if s.cursorRows > 0 {
+		s.moveUp(s.cursorRows)
+	}
+	s.cursorPos(0)
+	s.eraseDown()
+
+	var out strings.Builder
+	out.WriteString(string(prompt))
+	styles := s.styles(buf)
+	row, col := 0, countGlyphs(prompt)
+	cursorRow, cursorCol := row, col
+	for i, r := range buf {
+		if styles != nil {
+			out.WriteString(styles[i])
+		}
+		w := countGlyphs([]rune{r})
+		if r != '\n' && col+w > s.columns {
+			out.WriteString("\n")
+			row++
+			col = 0
+		}
+		if i == pos {
+			cursorRow, cursorCol = row, col
+		}
+		if r == '\n' {
+			out.WriteString("\n")
+			row++
+			col = 0
+			continue
+		}
+		out.WriteRune(r)
+		col += w
+	}
+	if pos == len(buf) {
+		cursorRow, cursorCol = row, col
+	}
+	if styles != nil {
+		out.WriteString("\x1b[0m")
+	}
+	if ghost := s.autoSuggestion(buf, pos); ghost != nil {
+		out.WriteString(dimmed(ghost, s.columns-col-1))
+	}
+	if col >= s.columns {
+		// Make room for the cursor after a full last row
+		out.WriteString("\n")
+		row++
+		col = 0
+	}
+	if cursorCol >= s.columns {
+		if cursorRow+1 == row && pos == len(buf) {
+			cursorRow, cursorCol = row, 0
+		} else {
+			cursorCol = s.columns - 1
+		}
+	}
+	_, err := fmt.Fprint(s.out, out.String())
+	if err != nil {
+		return err
+	}
+
+	if row > cursorRow {
+		s.moveUp(row - cursorRow)
+	}
+	s.cursorPos(cursorCol)
+
+	s.cursorRows = cursorRow
+	s.maxRows = row + 1
+	s.showMessage(row-cursorRow, cursorCol)
+	return nil
+}
+
+// cursorRowAt returns the row refreshMultiLine puts the cursor on when drawing
+// prompt and buf on a terminal that is columns wide.
+func cursorRowAt(prompt []rune, buf []rune, pos int, columns int) int {
+	row, col := 0, countGlyphs(prompt)
+	for _, r := range buf[:pos] {
+		if r == '\n' {
+			row++
+			col = 0
+			continue
+		}
+		w := countGlyphs([]rune{r})
+		if col+w > columns {
+			row++
+			col = 0
+		}
+		col += w
+	}
+	// The cursor goes to the start of the next row if the rune under it
+	// does not fit, or after a full last row
+	if pos < len(buf) && buf[pos] != '\n' && col+countGlyphs(buf[pos:pos+1]) > columns {
+		row++
+	} else if pos == len(buf) && col >= columns {
+		row++
+	}
+	return row
+}
+
+// rewrap updates s.cursorRows after the terminal was resized from columns
+// wide, for the next refreshMultiLine. Terminals that rewrap their rows on
+// resize leave the cursor on the row it would be on at the new width, others
+// on the same row. The lower of the two is kept, so that the redraw never
+// starts above the prompt, at the cost of leaving a few stale rows on some
+// terminals.
+func (s *State) rewrap(columns int) {
+	if (!s.multiLineMode && !s.softWrap) || s.cursorRows == 0 || columns == s.columns || s.columns == 0 {
+		return
+	}
+	if row := cursorRowAt(s.lastPrompt, s.lastBuf, s.lastPos, s.columns); row < s.cursorRows {
+		s.cursorRows = row
+	}
+}
+
+// drawFinal draws the line one last time as the prompt ends, leaving out the
+// autosuggestion, which is not part of the line. Nothing is drawn unless a
+// suggestion is shown or force is set.
+func (s *State) drawFinal(p []rune, line []rune, pos int, force bool) error {
+	if !force && s.autoSuggestion(line, pos) == nil {
+		return nil
+	}
+	s.noGhost = true
+	defer func() { s.noGhost = false }()
+	return s.refresh(p, line, pos)
+}
+
+// moveToLastRow puts the cursor on the last row drawn by refreshMultiLine, so
+// that whatever is printed next starts below the edited text.
+func (s *State) moveToLastRow() {
+	if n := s.maxRows - 1 - s.cursorRows; n > 0 {
+		s.moveDown(n)
+	}
+	s.cursorRows = 0
+	s.maxRows = 0
+}
+
+// startDeadline arms the deadline set with SetDeadline for the prompt about to
+// start.
+func (s *State) startDeadline() {
+	if s.deadline > 0 {
+		s.expired = time.After(s.deadline)
+	}
+}
+
+func (s *State) stopDeadline() {
+	s.expired = nil
+}
+
+// eraseInput clears the prompt row and every row drawn below it.
+func (s *State) eraseInput() {
+	if s.cursorRows > 0 {
+		s.moveUp(s.cursorRows)
+	}
+	s.cursorRows = 0
+	s.maxRows = 0
+	s.cursorPos(0)
+	s.eraseDown()
+}
+
+// rowBounds returns the start and end of the row of line holding pos, rows
+// being separated by newlines. The end excludes the newline.
+func rowBounds(line []rune, pos int) (start, end int) {
+	start = pos
+	for start > 0 && line[start-1] != '\n' {
+		start--
+	}
+	end = pos
+	for end < len(line) && line[end] != '\n' {
+		end++
+	}
+	return start, end
+}
+
+// sameColumn returns the position in the row of line starting at rowStart that
+// is in the screen column of pos. The first row starts after the prompt p.
+func sameColumn(p []rune, line []rune, pos, rowStart int) int {
+	start, _ := rowBounds(line, pos)
+	col := countGlyphs(line[start:pos])
+	if start == 0 {
+		col += countGlyphs(p)
+	}
+	_, rowEnd := rowBounds(line, rowStart)
+	if rowStart == 0 {
+		col = max(col-countGlyphs(p), 0)
+	}
+	return rowStart + columnPos(line[rowStart:rowEnd], col)
+}
+
 func (s *State) doBeep() {
 	if !s.noBeep {
-		fmt.Print(beep)
+		fmt.Fprint(s.out, beep)
 	}
 }
 
@@ -565,7 +1380,7 @@ func (s *State) eraseWord(pos int, line []rune, killAction int) (int, []rune, in
 
 func (s *State) yank(p []rune, text []rune, pos int) ([]rune, int, interface{}, error) {
 	if s.killRing == nil {
-		return text, pos, rune(esc), nil
+		return text, pos, unknown, nil
 	}
 
 	lineStart := text[:pos]
@@ -573,7 +1388,10 @@ func (s *State) yank(p []rune, text []rune, pos int) ([]rune, int, interface{},
 	var line []rune
 
 	for {
-		value := s.killRing.Value.([]rune)
+		value, cut := s.constrain(text, s.killRing.Value.([]rune))
+		if cut {
+			s.doBeep()
+		}
 		line = make([]rune, 0)
 		line = append(line, lineStart...)
 		line = append(line, value...)
@@ -600,6 +1418,356 @@ func (s *State) yank(p []rune, text []rune, pos int) ([]rune, int, interface{},
 			default:
 				return line, pos, next, nil
 			}
+		default:
+			return line, pos, next, nil
+		}
+	}
+}
+
+// validate runs the Validator on text.
+func (s *State) validate(text string) (err error) {
+	s.callback(func() { err = s.validator(text) })
+	return err
+}
+
+// filter runs the rune filter on r.
+func (s *State) filter(r rune) (ok bool) {
+	s.callback(func() { ok = s.runeFilter(r) })
+	return ok
+}
+
+// constrain returns the part of add that may be inserted into line under the
+// limits set with SetMaxLength, SetMaxWidth and SetRuneFilter, and whether
+// anything had to be left out.
+func (s *State) constrain(line []rune, add []rune) ([]rune, bool) {
+	if s.maxLength <= 0 && s.maxWidth <= 0 && s.runeFilter == nil {
+		return add, false
+	}
+	length, width := len(line), 0
+	if s.maxWidth > 0 {
+		width = countGlyphs(line)
+	}
+	var ok []rune
+	for _, r := range add {
+		if s.runeFilter != nil && !s.filter(r) {
+			continue
+		}
+		if s.maxLength > 0 && length+1 > s.maxLength {
+			break
+		}
+		if s.maxWidth > 0 {
+			w := countGlyphs([]rune{r})
+			if width+w > s.maxWidth {
+				break
+			}
+			width += w
+		}
+		length++
+		ok = append(ok, r)
+	}
+	return ok, len(ok) < len(add)
+}
+
+type tabDirection int
+
+const (
+	tabForward tabDirection = iota
+	tabReverse
+)
+
+// circularTabs returns a function that walks items in the given direction,
+// wrapping around at both ends.
+func (s *State) circularTabs(items []string) func(tabDirection) (string, error) {
+	item := -1
+	return func(direction tabDirection) (string, error) {
+		if direction == tabForward {
+			if item < len(items)-1 {
+				item++
+			} else {
+				item = 0
+			}
+		} else if direction == tabReverse {
+			if item > 0 {
+				item--
+			} else {
+				item = len(items) - 1
+			}
+		}
+		return items[item], nil
+	}
+}
+
+// completionQueryItems is the number of candidates above which printedTabs
+// asks before listing them all.
+const completionQueryItems = 100
+
+// printedTabs returns a function that completes to the longest common prefix
+// of items, and prints all of them in columns below the prompt from the second
+// tab on.
+func (s *State) printedTabs(items []string) func(tabDirection) (string, error) {
+	numTabs := 1
+	prefix := longestCommonPrefix(items)
+	return func(direction tabDirection) (string, error) {
+		if len(items) == 1 {
+			return items[0], nil
+		}
+
+		if numTabs < 2 {
+			numTabs++
+			return prefix, nil
+		}
+
+		s.moveToLastRow()
+		if len(items) > completionQueryItems {
+			fmt.Fprintf(s.out, "\nDisplay all %d possibilities? (y or n) ", len(items))
+		prompt:
+			for {
+				next, err := s.readNext()
+				if err != nil {
+					return prefix, err
+				}
+
+				if key, ok := next.(rune); ok {
+					switch key {
+					case ctrlC, ctrlD:
+						// The rune reader shuts down on these
+						s.restartPrompt()
+						fallthrough
+					case 'n', 'N', esc, ctrlG:
+						fmt.Fprintln(s.out)
+						return prefix, nil
+					case 'y', 'Y':
+						break prompt
+					case cr, lf:
+						s.restartPrompt()
+					}
+				}
+			}
+		}
+		fmt.Fprintln(s.out)
+
+		numColumns, numRows, maxWidth := calculateColumns(s.columns, items)
+		for i := 0; i < numRows; i++ {
+			for j := 0; j < numColumns*numRows; j += numRows {
+				if i+j >= len(items) {
+					continue
+				}
+				item := []rune(items[i+j])
+				if maxWidth > 0 {
+					fmt.Fprint(s.out, string(getPrefixGlyphs(item, maxWidth-1)))
+					if pad := maxWidth - countGlyphs(item); pad > 0 {
+						fmt.Fprint(s.out, strings.Repeat(" ", pad))
+					}
+				} else {
+					fmt.Fprintf(s.out, "%s ", string(item))
+				}
+			}
+			fmt.Fprintln(s.out)
+		}
+		return prefix, nil
+	}
+}
+
+// calculateColumns lays items out in columns that fit screenWidth. A
+// maxWidth of 0 means all items fit on a single row.
+func calculateColumns(screenWidth int, items []string) (numColumns, numRows, maxWidth int) {
+	for _, item := range items {
+		width := countGlyphs([]rune(item))
+		if width >= screenWidth {
+			return 1, len(items), screenWidth - 1
+		}
+		if width >= maxWidth {
+			maxWidth = width + 1
+		}
+	}
+
+	numColumns = screenWidth / maxWidth
+	numRows = len(items) / numColumns
+	if len(items)%numColumns > 0 {
+		numRows++
+	}
+
+	if len(items) <= numColumns {
+		maxWidth = 0
+	}
+
+	return
+}
+
+// tabComplete asks the completer for candidates and cycles through them on
+// Tab and Shift-Tab. Esc restores line and pos, any other key accepts the
+// current candidate and is handed back to the caller. unknown is handed back
+// when there is no key left to handle.
+func (s *State) tabComplete(p []rune, line []rune, pos int) ([]rune, int, interface{}, error) {
+	if s.completer == nil {
+		return line, pos, unknown, nil
+	}
+	var head, tail string
+	var list []string
+	s.callback(func() { head, list, tail = s.completer(string(line), pos) })
+	if len(list) <= 0 {
+		s.doBeep()
+		return line, pos, unknown, nil
+	}
+	// complete returns the line with pick in it, as much of it as the limits
+	// allow, and the cursor right after pick
+	complete := func(pick string) ([]rune, int) {
+		add, cut := s.constrain([]rune(head+tail), []rune(pick))
+		if cut {
+			s.doBeep()
+		}
+		completed := append(append([]rune(head), add...), []rune(tail)...)
+		return completed, utf8.RuneCountInString(head) + len(add)
+	}
+	if len(list) == 1 {
+		line, pos := complete(list[0])
+		return line, pos, unknown, nil
+	}
+
+	direction := tabForward
+	tabPrinter := s.circularTabs(list)
+	if s.tabStyle == TabPrints {
+		tabPrinter = s.printedTabs(list)
+	}
+
+	for {
+		pick, err := tabPrinter(direction)
+		if err != nil {
+			return line, pos, unknown, err
+		}
+		completed, end := complete(pick)
+		err = s.refresh(p, completed, end)
+		if err != nil {
+			return line, pos, unknown, err
+		}
+
+		next, err := s.readNext()
+		if err != nil {
+			return line, pos, unknown, err
+		}
+		if key, ok := next.(rune); ok {
+			if key == tab {
+				direction = tabForward
+				continue
+			}
+			if key == esc {
+				return line, pos, unknown, nil
+			}
+		}
+		if a, ok := next.(action); ok && a == shiftTab {
+			direction = tabReverse
+			continue
+		}
+		return completed, end, next, nil
+	}
+}
+
+// iSearch runs the incremental history search mode, starting from the newest
+// match if reverse is true, or from the oldest one otherwise. Ctrl-R and Ctrl-S
+// step to older and newer matches, Ctrl-G restores origLine and origPos. Any
+// other key accepts the match and is handed back to the caller, unknown if
+// there is none.
+func (s *State) iSearch(origLine []rune, origPos int, reverse bool) ([]rune, int, interface{}, error) {
+	var pattern []rune
+	foundLine := origLine
+	foundPos := origPos
+	failing := false // whether nothing matches pattern
+
+	getLine := func() ([]rune, []rune, int) {
+		mode := "i-search"
+		if reverse {
+			mode = "reverse-i-search"
+		}
+		if failing {
+			mode = "failed " + mode
+		}
+		prompt := fmt.Sprintf("(%s)`%s': ", mode, string(pattern))
+		return []rune(prompt), foundLine, foundPos
+	}
+
+	var history []string
+	var positions []int
+	historyPos := 0
+	// search looks up the matches of pattern and selects the newest (or
+	// oldest) one. Without a match, the last match stays selected.
+	search := func() {
+		history, positions = s.getHistoryByPattern(string(pattern))
+		failing = len(history) == 0 && len(pattern) > 0
+		if len(history) == 0 {
+			if failing {
+				s.doBeep()
+			}
+			return
+		}
+		historyPos = 0
+		if reverse {
+			historyPos = len(history) - 1
+		}
+		foundLine = []rune(history[historyPos])
+		foundPos = positions[historyPos]
+	}
+
+	for {
+		err := s.refresh(getLine())
+		if err != nil {
+			return foundLine, foundPos, unknown, err
+		}
+
+		next, err := s.readNext()
+		if err != nil {
+			return foundLine, foundPos, unknown, err
+		}
+
+		switch v := next.(type) {
+		case rune:
+			switch v {
+			case ctrlR: // Search backwards
+				reverse = true
+				if historyPos > 0 && historyPos < len(history) {
+					historyPos--
+					foundLine = []rune(history[historyPos])
+					foundPos = positions[historyPos]
+				} else {
+					s.doBeep()
+				}
+			case ctrlS: // Search forward
+				reverse = false
+				if historyPos < len(history)-1 && historyPos >= 0 {
+					historyPos++
+					foundLine = []rune(history[historyPos])
+					foundPos = positions[historyPos]
+				} else {
+					s.doBeep()
+				}
+			case ctrlH, bs: // Backspace
+				if len(pattern) == 0 {
+					s.doBeep()
+				} else {
+					n := len(getSuffixGlyphs(pattern, 1))
+					pattern = pattern[:len(pattern)-n]
+					search()
+				}
+			case ctrlG: // Cancel
+				return origLine, origPos, unknown, nil
+			case tab, cr, lf, ctrlA, ctrlB, ctrlD, ctrlE, ctrlF, ctrlK,
+				ctrlL, ctrlN, ctrlO, ctrlP, ctrlQ, ctrlT, ctrlU, ctrlV, ctrlW, ctrlX, ctrlY, ctrlZ:
+				fallthrough
+			case 0, ctrlC, esc, 28, 29, 30, 31:
+				return foundLine, foundPos, next, nil
+			default:
+				pattern = append(pattern, v)
+				search()
+			}
+		case action:
+			if v == winch {
+				// Only redraw
+				continue
+			}
+			return foundLine, foundPos, next, nil
+		case pasted:
+			text, _ := s.pasteText(v)
+			pattern = append(pattern, text...)
+			search()
 		}
 	}
 }
@@ -8,6 +8,13 @@ import (
 	"unsafe"
 )
 
+// printRequest is a message written through State.Write while a prompt is
+// active. done is closed once the message is on the terminal.
+type printRequest struct {
+	msg  []byte
+	done chan struct{}
+}
+
 type winSize struct {
 	row    uint16
 	col    uint16
@@ -15,9 +22,19 @@ type winSize struct {
 	ypixel uint16
 }
 
+// defaultColumns is the width of a terminal whose size cannot be read, until
+// SetColumns is called.
+const defaultColumns = 80
+
 func (s *State) getColumns() bool {
+	if s.outFd < 0 {
+		s.sizeMutex.Lock()
+		s.columns = s.fixedColumns
+		s.sizeMutex.Unlock()
+		return true
+	}
 	var ws winSize
-	ok, _, _ := unix.Syscall(unix.SYS_IOCTL, uintptr(unix.Stdout),
+	ok, _, _ := unix.Syscall(unix.SYS_IOCTL, uintptr(s.outFd),
 		unix.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
 	if int(ok) < 0 {
 		return false
@@ -26,6 +43,23 @@ func (s *State) getColumns() bool {
 	return true
 }
 
+// SetColumns sets the width of a terminal whose size cannot be read, as with
+// NewLinerWithIO and an outFd of -1. Call it again whenever the terminal is
+// resized, for example on an SSH window-change request; an active prompt is
+// then redrawn at the new width. SetColumns is safe to call from any
+// goroutine. It has no effect when the width is read from outFd.
+func (s *State) SetColumns(columns int) {
+	s.sizeMutex.Lock()
+	s.fixedColumns = columns
+	s.sizeMutex.Unlock()
+	if s.winch != nil && s.outFd < 0 {
+		select {
+		case s.winch <- unix.SIGWINCH:
+		default:
+		}
+	}
+}
+
 func (s *State) checkOutput() {
 	// xterm is known to support CHA
 	if strings.Contains(strings.ToLower(os.Getenv("TERM")), "xterm") {
@@ -45,20 +79,140 @@ func (s *State) checkOutput() {
 func (s *State) cursorPos(x int) {
 	if s.useCHA {
 		// 'G' is "Cursor Character Absolute (CHA)"
-		fmt.Printf("\x1b[%dG", x+1)
+		fmt.Fprintf(s.out, "\x1b[%dG", x+1)
 	} else {
 		// 'C' is "Cursor Forward (CUF)"
-		fmt.Print("\r")
+		fmt.Fprint(s.out, "\r")
 		if x > 0 {
-			fmt.Printf("\x1b[%dC", x)
+			fmt.Fprintf(s.out, "\x1b[%dC", x)
 		}
 	}
 }
 
 func (s *State) eraseLine() {
-	fmt.Print("\x1b[0K")
+	fmt.Fprint(s.out, "\x1b[0K")
 }
 
 func (s *State) eraseScreen() {
-	fmt.Print("\x1b[H\x1b[2J")
+	fmt.Fprint(s.out, "\x1b[H\x1b[2J")
+	// Nothing is left of the rows drawn so far
+	s.cursorRows = 0
+	s.maxRows = 0
+}
+
+// eraseDown clears from the cursor to the end of the screen.
+func (s *State) eraseDown() {
+	fmt.Fprint(s.out, "\x1b[0J")
+}
+
+func (s *State) moveUp(lines int) {
+	fmt.Fprintf(s.out, "\x1b[%dA", lines)
+}
+
+func (s *State) moveDown(lines int) {
+	fmt.Fprintf(s.out, "\x1b[%dB", lines)
+}
+
+// Write prints p on the terminal. While a prompt is active, the prompt and the
+// edited text are erased, p is printed in their place (followed by a newline if
+// it does not end with one), and the prompt is redrawn below it. Write is safe
+// to call from any goroutine, so the State can be used as the output of a
+// logger while the user is editing. It is also safe to call from a Completer,
+// Validator, Highlighter, AutoSuggester, EditFunc or rune filter; p is then
+// printed once the key being handled is done with.
+func (s *State) Write(p []byte) (int, error) {
+	s.printMutex.Lock()
+	if !s.prompting {
+		defer s.printMutex.Unlock()
+		return s.out.Write(p)
+	}
+	req := printRequest{msg: append([]byte(nil), p...), done: make(chan struct{})}
+	s.printQueue = append(s.printQueue, req)
+	// Waiting while a callback runs could wait on the very goroutine that
+	// has to do the printing
+	wait := s.callbacks == 0
+	s.printMutex.Unlock()
+
+	// Wake up the editing goroutine, which does the printing
+	select {
+	case s.printReady <- struct{}{}:
+	default:
+	}
+	if wait {
+		<-req.done
+	}
+	return len(p), nil
+}
+
+// callback runs f, a call into user code from the editing goroutine. Write
+// does not wait for its message to be printed meanwhile.
+func (s *State) callback(f func()) {
+	s.printMutex.Lock()
+	s.callbacks++
+	s.printMutex.Unlock()
+	defer func() {
+		s.printMutex.Lock()
+		s.callbacks--
+		s.printMutex.Unlock()
+	}()
+	f()
+}
+
+// Printf formats according to a format specifier and prints the result as
+// Write does.
+func (s *State) Printf(format string, a ...interface{}) (int, error) {
+	return fmt.Fprintf(s, format, a...)
+}
+
+// startPrinting routes the following calls to Write through the editing
+// goroutine.
+func (s *State) startPrinting() {
+	s.printMutex.Lock()
+	s.prompting = true
+	s.printMutex.Unlock()
+}
+
+// stopPrinting prints what is still queued, and lets Write print directly
+// again.
+func (s *State) stopPrinting() {
+	s.printMutex.Lock()
+	defer s.printMutex.Unlock()
+	s.prompting = false
+	s.writeQueue(s.printQueue)
+	s.printQueue = nil
+	s.lastPrompt = nil
+	s.lastBuf = nil
+}
+
+// printQueued prints the queued messages in place of the prompt, and redraws
+// the prompt below them.
+func (s *State) printQueued() {
+	s.printMutex.Lock()
+	queue := s.printQueue
+	s.printQueue = nil
+	s.printMutex.Unlock()
+	if len(queue) == 0 {
+		return
+	}
+
+	s.eraseInput()
+	s.writeQueue(queue)
+	s.refresh(s.lastPrompt, s.lastBuf, s.lastPos)
+}
+
+func (s *State) writeQueue(queue []printRequest) {
+	for _, req := range queue {
+		s.out.Write(req.msg)
+		if len(req.msg) > 0 && req.msg[len(req.msg)-1] != '\n' {
+			fmt.Fprintln(s.out)
+		}
+		close(req.done)
+	}
+}
+
+// remember keeps what refresh draws, so that printQueued can draw it again.
+func (s *State) remember(prompt []rune, buf []rune, pos int) {
+	s.lastPrompt = prompt
+	s.lastBuf = append(s.lastBuf[:0], buf...)
+	s.lastPos = pos
 }
@@ -0,0 +1,73 @@
+package liner
+
+import (
+	"strings"
+)
+
+// Bracketed paste: the terminal sends pasted text between pasteStart and
+// pasteEnd, so that it is not taken for typed keys.
+const (
+	pasteOn    = "\x1b[?2004h"
+	pasteOff   = "\x1b[?2004l"
+	pasteStart = 200 // ESC [ 200 ~
+	pasteEnd   = "\x1b[201~"
+)
+
+// pasted is the text of a bracketed paste, as returned by readNext.
+type pasted []rune
+
+// readPaste reads the text of a bracketed paste, up to pasteEnd.
+func (s *State) readPaste() (pasted, error) {
+	end := []rune(pasteEnd)
+	var text []rune
+	for {
+		next, err := s.nextRune()
+		if err != nil {
+			return nil, err
+		}
+		r, ok := next.(rune)
+		if !ok {
+			// Resized, the line is drawn again once the paste is in
+			continue
+		}
+		if !s.reading {
+			// The rune reader shuts down after newlines and a few control
+			// keys, but there is more to paste
+			s.restartPrompt()
+		}
+		text = append(text, r)
+		if len(text) >= len(end) && string(text[len(text)-len(end):]) == pasteEnd {
+			return text[:len(text)-len(end)], nil
+		}
+	}
+}
+
+// pasteText returns the text of p to insert into the line, following the
+// PasteMode, and whether the line should then be accepted. Control runes are
+// left out, and tabs become spaces.
+func (s *State) pasteText(p pasted) ([]rune, bool) {
+	text := strings.ReplaceAll(string(p), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	submit := false
+	if s.pasteMode == PasteSubmit {
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[:i]
+			submit = true
+		}
+	}
+	keep := s.pasteMode == PasteKeep && s.multiLineMode
+	var out []rune
+	for _, r := range text {
+		switch {
+		case r == '\n' && keep:
+			out = append(out, r)
+		case r == '\n' || r == '\t':
+			out = append(out, ' ')
+		case r < ' ' || r == bs:
+			// Left out
+		default:
+			out = append(out, r)
+		}
+	}
+	return out, submit
+}
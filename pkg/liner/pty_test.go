@@ -0,0 +1,1032 @@
+package liner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptyTerm is the master side of a pseudo-terminal, with everything written to
+// the slave side collected in out.
+type ptyTerm struct {
+	t      *testing.T
+	master *os.File
+	slave  *os.File
+	sfd    int
+
+	mu      sync.Mutex
+	out     bytes.Buffer
+	written time.Time
+}
+
+// openPty opens a pseudo-terminal cols columns wide. The test is skipped if
+// the system has none to offer.
+func openPty(t *testing.T, cols int) *ptyTerm {
+	t.Helper()
+	t.Setenv("TERM", "xterm")
+
+	mfd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminal available: %v", err)
+	}
+	if err := unix.IoctlSetPointerInt(mfd, unix.TIOCSPTLCK, 0); err != nil {
+		unix.Close(mfd)
+		t.Fatalf("unlocking pty: %v", err)
+	}
+	n, err := unix.IoctlGetInt(mfd, unix.TIOCGPTN)
+	if err != nil {
+		unix.Close(mfd)
+		t.Fatalf("getting pty number: %v", err)
+	}
+	sfd, err := unix.Open(fmt.Sprintf("/dev/pts/%d", n), unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(mfd)
+		t.Fatalf("opening pty slave: %v", err)
+	}
+	ws := unix.Winsize{Row: 24, Col: uint16(cols)}
+	if err := unix.IoctlSetWinsize(sfd, unix.TIOCSWINSZ, &ws); err != nil {
+		t.Fatalf("setting pty size: %v", err)
+	}
+
+	// Non-blocking descriptors go through the runtime poller, so that closing
+	// the files interrupts pending reads
+	unix.SetNonblock(mfd, true)
+	unix.SetNonblock(sfd, true)
+
+	p := &ptyTerm{
+		t:      t,
+		master: os.NewFile(uintptr(mfd), "/dev/ptmx"),
+		slave:  os.NewFile(uintptr(sfd), "/dev/pts"),
+		sfd:    sfd,
+	}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		buf := make([]byte, 1024)
+		for {
+			n, err := p.master.Read(buf)
+			p.mu.Lock()
+			p.out.Write(buf[:n])
+			p.written = time.Now()
+			p.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		p.slave.Close()
+		p.master.Close()
+		<-copied
+	})
+	return p
+}
+
+// settle waits until nothing has been written to the terminal for a while.
+func (p *ptyTerm) settle() {
+	const quiet = 30 * time.Millisecond
+	for {
+		time.Sleep(quiet / 3)
+		p.mu.Lock()
+		idle := time.Since(p.written)
+		p.mu.Unlock()
+		if idle >= quiet {
+			return
+		}
+	}
+}
+
+// output returns everything written to the terminal so far.
+func (p *ptyTerm) output() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.out.String()
+}
+
+// run starts prompt on a new State bound to the pty, types every element of
+// keys in turn, letting the output settle in between, and returns the result
+// of prompt.
+func (p *ptyTerm) run(setup func(*State), prompt func(*State) (string, error), keys ...string) (string, error) {
+	p.t.Helper()
+	s := NewLinerWithIO(p.slave, p.slave, p.sfd, p.sfd)
+	defer s.Close()
+	if setup != nil {
+		setup(s)
+	}
+	return p.runOn(s, prompt, keys...)
+}
+
+// runOn is like run, but uses the existing State s.
+func (p *ptyTerm) runOn(s *State, prompt func(*State) (string, error), keys ...string) (string, error) {
+	p.t.Helper()
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := prompt(s)
+		done <- result{line, err}
+	}()
+
+	p.settle()
+	for _, k := range keys {
+		if _, err := io.WriteString(p.master, k); err != nil {
+			p.t.Fatalf("writing keys: %v", err)
+		}
+		if k == "\x1b" {
+			// Let readNext give up waiting for an escape sequence
+			time.Sleep(100 * time.Millisecond)
+		}
+		p.settle()
+	}
+
+	select {
+	case r := <-done:
+		p.settle()
+		return r.line, r.err
+	case <-time.After(5 * time.Second):
+		p.t.Fatalf("prompt did not return, terminal shows %q", p.output())
+		return "", nil
+	}
+}
+
+func suggest(text string, pos int) func(*State) (string, error) {
+	return func(s *State) (string, error) {
+		return s.PromptWithSuggestion("> ", text, pos)
+	}
+}
+
+func TestPtyEditing(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(*State)
+		prompt func(*State) (string, error)
+		keys   []string
+		want   string
+		// tail is the expected end of the terminal output
+		tail string
+	}{
+		{
+			name:   "type",
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"hello", "\r"},
+			want:   "hello",
+			tail:   "> " + pasteOn + "hello\r\n",
+		},
+		{
+			name:   "suggestion",
+			prompt: suggest("hello world", 5),
+			keys:   []string{",", "\r"},
+			want:   "hello, world",
+			tail:   "\x1b[1G> hello, world\x1b[0K\x1b[9G\r\n",
+		},
+		{
+			name:   "home and end",
+			prompt: suggest("bc", -1),
+			keys:   []string{"\x01", "a", "\x1b[F", "d", "\r"},
+			want:   "abcd",
+			tail:   "\x1b[1G> abc\x1b[0K\x1b[6Gd\r\n",
+		},
+		{
+			name:   "transpose",
+			prompt: suggest("abcd", 2),
+			keys:   []string{"\x14", "\r"},
+			want:   "acbd",
+			tail:   "\x1b[1G> acbd\x1b[0K\x1b[6G\r\n",
+		},
+		{
+			name:   "transpose at end",
+			prompt: suggest("abcd", -1),
+			keys:   []string{"\x14", "\r"},
+			want:   "abdc",
+			tail:   "\x1b[1G> abdc\x1b[0K\x1b[7G\r\n",
+		},
+		{
+			name:   "erase word",
+			prompt: suggest("foo bar", -1),
+			keys:   []string{"\x17", "\r"},
+			want:   "foo ",
+			tail:   "\x1b[1G> foo \x1b[0K\x1b[7G\r\n",
+		},
+		{
+			name:   "alt-d",
+			prompt: suggest("foo bar baz", 3),
+			keys:   []string{"\x1bd", "\r"},
+			want:   "foo baz",
+			tail:   "\x1b[1G> foo baz\x1b[0K\x1b[6G\r\n",
+		},
+		{
+			name:   "word motion",
+			prompt: suggest("one two three", -1),
+			keys:   []string{"\x1bb", "\x1b[1;5D", "_", "\x1bf", "_", "\r"},
+			want:   "one _two_ three",
+		},
+		{
+			name:   "kill and yank",
+			prompt: suggest("foo bar", -1),
+			keys:   []string{"\x17", "\x01", "\x19", "\r"},
+			want:   "barfoo ",
+			tail:   "\x1b[1G> barfoo \x1b[0K\x1b[6G\r\n",
+		},
+		{
+			name:   "yank pop",
+			prompt: suggest("one two", -1),
+			keys:   []string{"\x17", "\x1b[D", "\x17", "\x19", "\x1by", "\r"},
+			want:   "two ",
+		},
+		{
+			name:   "kill line",
+			prompt: suggest("keep drop", 4),
+			keys:   []string{"\x0b", "\r"},
+			want:   "keep",
+		},
+		{
+			name:   "backspace and delete",
+			prompt: suggest("abcd", 2),
+			keys:   []string{"\x7f", "\x1b[3~", "\r"},
+			want:   "ad",
+		},
+		{
+			name:   "ctrl-c resets",
+			prompt: suggest("abc", -1),
+			keys:   []string{"\x03", "x", "\r"},
+			want:   "x",
+			tail:   "^C\r\n> x\r\n",
+		},
+		{
+			name:   "history",
+			setup:  func(s *State) { s.AppendHistory("first"); s.AppendHistory("second") },
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"f", "\x1b[A", "!", "\r"},
+			want:   "first!",
+		},
+		{
+			name:   "reverse search",
+			setup:  func(s *State) { s.AppendHistory("make test"); s.AppendHistory("go vet") },
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"\x12", "ke", "\x05", "s", "\r"},
+			want:   "make tests",
+		},
+		{
+			name:   "failed reverse search",
+			setup:  func(s *State) { s.AppendHistory("make test") },
+			prompt: suggest("orig", -1),
+			keys:   []string{"\x12", "ma", "zz", "\x05", "\r"},
+			want:   "make test",
+		},
+		{
+			name:   "reverse search without a match",
+			setup:  func(s *State) { s.AppendHistory("make test") },
+			prompt: suggest("orig", -1),
+			keys:   []string{"\x12", "zz", "\x05", "\r"},
+			want:   "orig",
+		},
+		{
+			name: "completion",
+			setup: func(s *State) {
+				s.SetCompleter(func(line string) []string {
+					return []string{line + "1", line + "2"}
+				})
+			},
+			prompt: suggest("x", -1),
+			keys:   []string{"\t", "\t", "\r"},
+			want:   "x2",
+		},
+		{
+			name: "deadline submits",
+			setup: func(s *State) {
+				s.SetDeadline(200 * time.Millisecond)
+				s.SetTimeoutSubmits(true)
+			},
+			prompt: suggest("default", -1),
+			keys:   []string{"!"},
+			want:   "default!",
+		},
+		{
+			name:   "vi delete word",
+			setup:  func(s *State) { s.SetViMode(true) },
+			prompt: suggest("one two three", -1),
+			keys:   []string{"\x1b", "0dw", "\r"},
+			want:   "two three",
+		},
+		{
+			name:   "vi change word and repeat",
+			setup:  func(s *State) { s.SetViMode(true) },
+			prompt: suggest("one two three", -1),
+			keys:   []string{"\x1b", "0cw", "1", "\x1b", "w.", "\r"},
+			want:   "1 1 three",
+		},
+		{
+			name:   "vi count and find",
+			setup:  func(s *State) { s.SetViMode(true) },
+			prompt: suggest("a.b.c.d", -1),
+			keys:   []string{"\x1b", "02f.", "D", "\r"},
+			want:   "a.b",
+		},
+		{
+			name:   "vi till and repeat",
+			setup:  func(s *State) { s.SetViMode(true) },
+			prompt: suggest("a)b)c)", -1),
+			keys:   []string{"\x1b", "0dt)", "t);D", "\r"},
+			want:   ")b)",
+		},
+		{
+			name: "vi insert mode after completion",
+			setup: func(s *State) {
+				s.SetViMode(true)
+				s.SetCompleter(func(line string) []string { return []string{line + "1"} })
+			},
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"x", "\t", "ab", "\r"},
+			want:   "x1ab",
+		},
+		{
+			name:   "vi insert mode after empty yank and cancelled search",
+			setup:  func(s *State) { s.SetViMode(true) },
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"x", "\x19", "a", "\x12", "\x07", "b", "\r"},
+			want:   "xab",
+		},
+		{
+			name:   "vi enter and ctrl-c as command arguments",
+			setup:  func(s *State) { s.SetViMode(true) },
+			prompt: suggest("abc", -1),
+			keys:   []string{"\x1b", "0r\r", "d\r", "f\x03", "x", "\r"},
+			want:   "bc",
+		},
+		{
+			name: "vi history with ctrl-p",
+			setup: func(s *State) {
+				s.SetViMode(true)
+				s.AppendHistory("first")
+			},
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"\x1b", "\x10", "\r"},
+			want:   "first",
+		},
+		{
+			name:   "vi yank put and undo",
+			setup:  func(s *State) { s.SetViMode(true) },
+			prompt: suggest("ab", -1),
+			keys:   []string{"\x1b", "0yl", "$p", "rz", "u", "\r"},
+			want:   "aba",
+		},
+		{
+			name: "bind command",
+			setup: func(s *State) {
+				s.Bind(KeyCtrlO, BackwardWord)
+				s.Bind(KeyCtrlB, KillLine)
+			},
+			prompt: suggest("one two", -1),
+			keys:   []string{"\x0f", "\x02", "2", "\r"},
+			want:   "one 2",
+		},
+		{
+			name: "bind function",
+			setup: func(s *State) {
+				s.Bind(KeyF1, EditFunc(func(line []rune, pos int) ([]rune, int) {
+					return append([]rune("sudo "), line...), pos + 5
+				}))
+			},
+			prompt: suggest("ls", -1),
+			keys:   []string{"\x1bOP", "!", "\r"},
+			want:   "sudo ls!",
+		},
+		{
+			name:   "bind enter",
+			setup:  func(s *State) { s.Bind(KeyEnter, Ignore); s.Bind(KeyCtrlX, AcceptLine) },
+			prompt: suggest("a", -1),
+			keys:   []string{"\r", "b", "\x18"},
+			want:   "ab",
+		},
+		{
+			name:   "undo typing",
+			prompt: suggest("ab", -1),
+			keys:   []string{"cd", "\x02", "e", "\x1f", "\x1f", "\r"},
+			want:   "ab",
+		},
+		{
+			name:   "undo and redo kill",
+			prompt: suggest("hello world", 5),
+			keys:   []string{"\x0b", "\x18\x15", "\x18\x12", "\r"},
+			want:   "hello",
+		},
+		{
+			name:   "undo yank apart from typing",
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"ab", "\x17", "cd", "\x19", "e", "\x1f", "\x1f", "\r"},
+			want:   "cd",
+		},
+		{
+			name: "undo completion apart from typing",
+			setup: func(s *State) {
+				s.SetCompleter(func(line string) []string { return []string{line + "1"} })
+			},
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"x", "\t", "y", "\x1f", "\x1f", "\r"},
+			want:   "x",
+		},
+		{
+			name:   "revert line",
+			prompt: suggest("abc", 1),
+			keys:   []string{"x", "\x01", "\x0b", "\x1br", "!", "\r"},
+			want:   "a!bc",
+		},
+		{
+			name: "validator",
+			setup: func(s *State) {
+				s.SetValidator(func(line string) error {
+					if line != "ok" {
+						return errors.New("say ok")
+					}
+					return nil
+				})
+			},
+			prompt: suggest("o", -1),
+			keys:   []string{"\r", "k", "\r"},
+			want:   "ok",
+			tail:   "\x1b[1G\x1b[0J> ok\x1b[0K\x1b[5G\r\n",
+		},
+		{
+			name:   "max length",
+			setup:  func(s *State) { s.SetMaxLength(3) },
+			prompt: suggest("ab", -1),
+			keys:   []string{"cde", "\r"},
+			want:   "abc",
+		},
+		{
+			name:   "rune filter and yank",
+			setup:  func(s *State) { s.SetRuneFilter(unicode.IsDigit) },
+			prompt: suggest("a1b2", -1),
+			keys:   []string{"\x15", "x", "\x19", "3", "\r"},
+			want:   "123",
+		},
+		{
+			name: "completion with limits",
+			setup: func(s *State) {
+				s.SetMaxLength(6)
+				s.SetRuneFilter(func(r rune) bool { return r != '-' })
+				s.SetCompleter(func(line string) []string { return []string{line + "-long-word"} })
+			},
+			prompt: suggest("ab", -1),
+			keys:   []string{"\t", "\r"},
+			want:   "ablong",
+		},
+		{
+			name: "vi put and repeat with max length",
+			setup: func(s *State) {
+				s.SetViMode(true)
+				s.SetMaxLength(5)
+			},
+			prompt: suggest("ab", -1),
+			keys:   []string{"\x1b", "0icd", "\x1b", ".", "yl", "p", "\r"},
+			want:   "ccdab",
+		},
+		{
+			name: "vi replace with rune filter",
+			setup: func(s *State) {
+				s.SetViMode(true)
+				s.SetRuneFilter(unicode.IsDigit)
+			},
+			prompt: suggest("12", -1),
+			keys:   []string{"\x1b", "0rx", "r3", "\r"},
+			want:   "32",
+		},
+		{
+			name: "highlighter",
+			setup: func(s *State) {
+				s.SetHighlighter(func(line []rune) string {
+					var b strings.Builder
+					for _, r := range line {
+						if unicode.IsDigit(r) {
+							fmt.Fprintf(&b, "\x1b[1m%c\x1b[0m", r)
+						} else {
+							b.WriteRune(r)
+						}
+					}
+					return b.String()
+				})
+			},
+			prompt: suggest("a1", -1),
+			keys:   []string{"2", "\r"},
+			want:   "a12",
+			tail:   "\x1b[1G> a\x1b[1m1\x1b[0m\x1b[1m2\x1b[0m\x1b[0K\x1b[6G\r\n",
+		},
+		{
+			name: "autosuggestion",
+			setup: func(s *State) {
+				s.AppendHistory("git commit -m")
+				s.SetAutoSuggester(s.HistoryAutoSuggestion)
+			},
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"g", "\x1bf", "\x1bf", "!", "\r"},
+			want:   "git commit!",
+			tail:   "\x1b[1G> git commit!\x1b[0K\x1b[14G\r\n",
+		},
+		{
+			name: "accept autosuggestion",
+			setup: func(s *State) {
+				s.AppendHistory("make test")
+				s.SetAutoSuggester(s.HistoryAutoSuggestion)
+			},
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"ma", "\x1b[C", "\r"},
+			want:   "make test",
+		},
+		{
+			name: "autosuggestion cleared on enter",
+			setup: func(s *State) {
+				s.AppendHistory("make test")
+				s.SetAutoSuggester(s.HistoryAutoSuggestion)
+			},
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"ma", "\r"},
+			want:   "ma",
+			tail:   "\x1b[1G> ma\x1b[0K\x1b[5G\r\n",
+		},
+		{
+			name:   "paste",
+			prompt: suggest("a", -1),
+			keys:   []string{"\x1b[200~b\rc\x03d\x1b[201~", "\r"},
+			want:   "ab cd",
+		},
+		{
+			name:   "paste keeps newlines",
+			setup:  func(s *State) { s.SetMultiLineMode(true); s.SetPasteMode(PasteKeep) },
+			prompt: suggest("a", -1),
+			keys:   []string{"\x1b[200~b\r\nc\x1b[201~", "\r"},
+			want:   "ab\nc",
+		},
+		{
+			name:   "paste submits",
+			setup:  func(s *State) { s.SetPasteMode(PasteSubmit) },
+			prompt: suggest("a", -1),
+			keys:   []string{"\x1b[200~xy\rz\x1b[201~"},
+			want:   "axy",
+		},
+		{
+			name:   "undo paste",
+			prompt: suggest("a", -1),
+			keys:   []string{"b", "\x1b[200~xyz\x1b[201~", "\x1f", "\r"},
+			want:   "ab",
+		},
+		{
+			name: "word completion in the middle of the line",
+			setup: func(s *State) {
+				s.SetWordCompleter(func(line string, pos int) (string, []string, string) {
+					start := strings.LastIndex(line[:pos], " ") + 1
+					end := pos + strings.IndexByte(line[pos:]+" ", ' ')
+					return line[:start], []string{"checkout"}, line[end:]
+				})
+			},
+			prompt: suggest("git ch main", 6),
+			keys:   []string{"\t", "!", "\r"},
+			want:   "git checkout! main",
+			tail:   "\x1b[1G> git checkout main\x1b[0K\x1b[15G\x1b[1G> git checkout! main\x1b[0K\x1b[16G\r\n",
+		},
+		{
+			name: "completion listing",
+			setup: func(s *State) {
+				s.SetTabCompletionStyle(TabPrints)
+				s.SetCompleter(func(line string) []string {
+					return []string{"ab1", "ab22", "ab333"}
+				})
+			},
+			prompt: suggest("a", -1),
+			keys:   []string{"\t", "\t", "\r"},
+			want:   "ab",
+			tail:   "\x1b[1G> ab\x1b[0K\x1b[5G\r\nab1 ab22 ab333 \r\n\x1b[1G> ab\x1b[0K\x1b[5G\x1b[1G> ab\x1b[0K\x1b[5G\r\n",
+		},
+		{
+			name:   "multi-line prompt",
+			prompt: func(s *State) (string, error) { return s.Prompt("header\n> ") },
+			keys:   []string{"ab", "\r"},
+			want:   "ab",
+			tail:   "header\r\n> " + pasteOn + "ab\r\n",
+		},
+		{
+			name:   "multi-line prompt reprinted on ctrl-l",
+			prompt: func(s *State) (string, error) { return s.Prompt("header\n> ") },
+			keys:   []string{"ab", "\x0c", "\r"},
+			want:   "ab",
+			tail:   "\x1b[H\x1b[2Jheader\r\n\x1b[1G> ab\x1b[0K\x1b[5G\r\n",
+		},
+		{
+			name:   "multi-line buffer alt-enter",
+			setup:  func(s *State) { s.SetMultiLineMode(true) },
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"ab", "\x1b\r", "cd", "\r"},
+			want:   "ab\ncd",
+			tail:   "\x1b[1G\x1b[0J> ab\r\n\x1b[1Gcd\r\n",
+		},
+		{
+			name: "multi-line buffer newline key",
+			setup: func(s *State) {
+				s.SetMultiLineMode(true)
+				s.SetNewlineKey('\n')
+			},
+			prompt: func(s *State) (string, error) { return s.Prompt("> ") },
+			keys:   []string{"ab", "\n", "cd", "\r"},
+			want:   "ab\ncd",
+			tail:   "\x1b[1G\x1b[0J> ab\r\n\x1b[1Gcd\r\n",
+		},
+		{
+			name:   "sgr prompt width",
+			prompt: func(s *State) (string, error) { return s.Prompt("\x1b[32m>\x1b[0m ") },
+			keys:   []string{"ab", "\x01", "\r"},
+			want:   "ab",
+			tail:   "\x1b[1G\x1b[32m>\x1b[0m ab\x1b[0K\x1b[3G\r\n",
+		},
+		{
+			name:   "osc 8 prompt width",
+			prompt: func(s *State) (string, error) { return s.Prompt("\x1b]8;;https://example.com\x07link\x1b]8;;\x07> ") },
+			keys:   []string{"ab", "\x01", "\r"},
+			want:   "ab",
+			tail:   "\x1b[1G\x1b]8;;https://example.com\alink\x1b]8;;\a> ab\x1b[0K\x1b[7G\r\n",
+		},
+		{
+			name:   "multi-line buffer up counts the prompt",
+			setup:  func(s *State) { s.SetMultiLineMode(true) },
+			prompt: suggest("abc\nde", -1),
+			keys:   []string{"\x1b[A", "X", "\r"},
+			want:   "Xabc\nde",
+		},
+		{
+			name:   "multi-line buffer down counts the prompt",
+			setup:  func(s *State) { s.SetMultiLineMode(true) },
+			prompt: suggest("abc\nde", 1),
+			keys:   []string{"\x1b[B", "X", "\r"},
+			want:   "abc\ndeX",
+		},
+		{
+			name:   "password",
+			setup:  func(s *State) { s.SetPasswordMask('*') },
+			prompt: func(s *State) (string, error) { return s.PasswordPrompt("pw: ") },
+			keys:   []string{"secret", "\x7f", "\r"},
+			want:   "secre",
+			tail:   "\x1b[1Gpw: *****\x1b[0K\x1b[10G\r\n",
+		},
+		{
+			name:   "password without a mask",
+			prompt: func(s *State) (string, error) { return s.PasswordPrompt("pw: ") },
+			keys:   []string{"abc", "\x0c", "d", "\r"},
+			want:   "abcd",
+			tail:   "\x1b[H\x1b[2J\x1b[1Gpw: \x1b[0K\x1b[5G\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := openPty(t, 80)
+			got, err := p.run(tt.setup, tt.prompt, tt.keys...)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// Every prompt ends by turning bracketed paste off
+			if out := p.output(); !strings.HasSuffix(out, tt.tail+pasteOff) {
+				t.Errorf("terminal output %q does not end with %q", out, tt.tail+pasteOff)
+			}
+		})
+	}
+}
+
+func TestPtyErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*State)
+		keys  []string
+		want  error
+		tail  string
+		// password runs PasswordPrompt instead of Prompt
+		password bool
+	}{
+		{
+			name: "ctrl-d on empty line",
+			keys: []string{"\x04"},
+			want: io.EOF,
+		},
+		{
+			name:  "ctrl-c aborts",
+			setup: func(s *State) { s.SetCtrlCAborts(true) },
+			keys:  []string{"abc", "\x03"},
+			want:  ErrPromptAborted,
+		},
+		{
+			name:  "idle timeout",
+			setup: func(s *State) { s.SetIdleTimeout(100 * time.Millisecond) },
+			keys:  []string{"a", "b"},
+			want:  ErrPromptTimeout,
+		},
+		{
+			name:  "deadline during a paste",
+			setup: func(s *State) { s.SetDeadline(200 * time.Millisecond) },
+			keys:  []string{"\x1b[200~abc"},
+			want:  ErrPromptTimeout,
+		},
+		{
+			name: "ctrl-c clears the autosuggestion",
+			setup: func(s *State) {
+				s.SetCtrlCAborts(true)
+				s.AppendHistory("make test")
+				s.SetAutoSuggester(s.HistoryAutoSuggestion)
+			},
+			keys: []string{"ma", "\x03"},
+			want: ErrPromptAborted,
+			tail: "\x1b[1G> ma\x1b[0K\x1b[5G^C\r\n",
+		},
+		{
+			name: "deadline clears the autosuggestion",
+			setup: func(s *State) {
+				s.SetDeadline(200 * time.Millisecond)
+				s.AppendHistory("make test")
+				s.SetAutoSuggester(s.HistoryAutoSuggestion)
+			},
+			keys: []string{"ma"},
+			want: ErrPromptTimeout,
+			tail: "\x1b[1G> ma\x1b[0K\x1b[5G\r\n",
+		},
+		{
+			name: "deadline does not submit a password",
+			setup: func(s *State) {
+				s.SetDeadline(200 * time.Millisecond)
+				s.SetTimeoutSubmits(true)
+			},
+			keys:     []string{"secret"},
+			want:     ErrPromptTimeout,
+			password: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := openPty(t, 80)
+			prompt := func(s *State) (string, error) { return s.Prompt("> ") }
+			if tt.password {
+				prompt = func(s *State) (string, error) { return s.PasswordPrompt("> ") }
+			}
+			_, err := p.run(tt.setup, prompt, tt.keys...)
+			if err != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+			if out := p.output(); !strings.HasSuffix(out, tt.tail+pasteOff) {
+				t.Errorf("terminal output %q does not end with %q", out, tt.tail+pasteOff)
+			}
+		})
+	}
+}
+
+func TestPtyTooNarrow(t *testing.T) {
+	p := openPty(t, 8)
+	got, err := p.run(nil, func(s *State) (string, error) { return s.Prompt("> ") }, "abc\r")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got != "abc" {
+		t.Errorf("got %q, want %q", got, "abc")
+	}
+}
+
+func TestPtySoftWrap(t *testing.T) {
+	p := openPty(t, 20)
+	s := NewLinerWithIO(p.slave, p.slave, p.sfd, p.sfd)
+	defer s.Close()
+	s.SetSoftWrap(true)
+
+	done := make(chan string, 1)
+	go func() {
+		line, _ := s.PromptWithSuggestion("> ", "abcdefghijklmnopqrstuvwxyz0123", -1)
+		done <- line
+	}()
+	p.settle()
+
+	// Each frame goes back to the prompt row, clears everything below and
+	// draws the wrapped rows, leaving the cursor after the last rune
+	steps := []struct {
+		cols int
+		keys string
+		want string
+	}{
+		{20, "!", "\x1b[1A\x1b[1G\x1b[0J> abcdefghijklmnopqr\r\nstuvwxyz0123!\x1b[14G"},
+		{10, "", "\x1b[1A\x1b[1G\x1b[0J> abcdefgh\r\nijklmnopqr\r\nstuvwxyz01\r\n23!\x1b[4G"},
+		{40, "", "\x1b[1G\x1b[0J> abcdefghijklmnopqrstuvwxyz0123!\x1b[34G"},
+		{40, "\x15", "\x1b[1G\x1b[0J> \x1b[3G"},
+	}
+	cols := 20
+	for _, step := range steps {
+		if step.cols != cols {
+			cols = step.cols
+			ws := unix.Winsize{Row: 24, Col: uint16(step.cols)}
+			if err := unix.IoctlSetWinsize(p.sfd, unix.TIOCSWINSZ, &ws); err != nil {
+				t.Fatalf("setting pty size: %v", err)
+			}
+			s.winch <- unix.SIGWINCH
+		}
+		io.WriteString(p.master, step.keys)
+		p.settle()
+		if out := p.output(); !strings.HasSuffix(out, step.want) {
+			t.Errorf("terminal output %q does not end with %q", out, step.want)
+		}
+	}
+
+	io.WriteString(p.master, "x\r")
+	select {
+	case line := <-done:
+		if line != "x" {
+			t.Errorf("got %q, want %q", line, "x")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("prompt did not return, terminal shows %q", p.output())
+	}
+}
+
+func TestPtyContextCancel(t *testing.T) {
+	p := openPty(t, 80)
+	s := NewLinerWithIO(p.slave, p.slave, p.sfd, p.sfd)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.PromptWithSuggestionContext(ctx, "> ", "abc", -1)
+		done <- err
+	}()
+	p.settle()
+	io.WriteString(p.master, "d")
+	p.settle()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("prompt was not cancelled")
+	}
+	p.settle()
+	if out := p.output(); !strings.HasSuffix(out, "\x1b[1G\x1b[0J"+pasteOff) {
+		t.Errorf("terminal output %q does not end with the line erased", out)
+	}
+
+	// The next prompt gets the keys typed after the cancellation
+	got, err := p.runOn(s, func(s *State) (string, error) { return s.Prompt("> ") }, "xy\r")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got != "xy" {
+		t.Errorf("got %q, want %q", got, "xy")
+	}
+}
+
+func TestPtyPrintAbovePrompt(t *testing.T) {
+	p := openPty(t, 80)
+	s := NewLinerWithIO(p.slave, p.slave, p.sfd, p.sfd)
+	defer s.Close()
+
+	got, err := p.runOn(s, func(s *State) (string, error) {
+		go func() {
+			p.settle()
+			s.Printf("log %d", 1)
+			io.WriteString(p.master, "c\r")
+		}()
+		return s.PromptWithSuggestion("> ", "ab", -1)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got != "abc" {
+		t.Errorf("got %q, want %q", got, "abc")
+	}
+	want := "\x1b[1G\x1b[0Jlog 1\r\n\x1b[1G> ab\x1b[0K\x1b[5Gc\r\n" + pasteOff
+	if out := p.output(); !strings.HasSuffix(out, want) {
+		t.Errorf("terminal output %q does not end with %q", out, want)
+	}
+
+	// Without a prompt, the message is printed as is
+	s.Printf("done\n")
+	p.settle()
+	if out := p.output(); !strings.HasSuffix(out, "c\r\n"+pasteOff+"done\r\n") {
+		t.Errorf("terminal output %q does not end with the message", out)
+	}
+
+	// An unmasked password prompt is redrawn without the typed runes
+	got, err = p.runOn(s, func(s *State) (string, error) {
+		go func() {
+			io.WriteString(p.master, "pw")
+			p.settle()
+			s.Printf("log %d", 2)
+			io.WriteString(p.master, "\r")
+		}()
+		return s.PasswordPrompt("pw: ")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got != "pw" {
+		t.Errorf("got %q, want %q", got, "pw")
+	}
+	want = "\x1b[1G\x1b[0Jlog 2\r\n\x1b[1Gpw: \x1b[0K\x1b[5G\r\n" + pasteOff
+	if out := p.output(); !strings.HasSuffix(out, want) {
+		t.Errorf("terminal output %q does not end with %q", out, want)
+	}
+}
+
+func TestPtyPrintFromCallback(t *testing.T) {
+	p := openPty(t, 80)
+	got, err := p.run(func(s *State) {
+		s.SetCompleter(func(line string) []string {
+			s.Printf("completing %q", line)
+			return []string{line + "c"}
+		})
+	}, suggest("ab", -1), "\t", "\r")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got != "abc" {
+		t.Errorf("got %q, want %q", got, "abc")
+	}
+	if out := p.output(); !strings.Contains(out, "completing \"ab\"\r\n") {
+		t.Errorf("terminal output %q does not show the message", out)
+	}
+}
+
+func TestPtyCompletionQuery(t *testing.T) {
+	for _, key := range []string{"n", "\x03", "\x1b"} {
+		p := openPty(t, 80)
+		got, err := p.run(func(s *State) {
+			s.SetTabCompletionStyle(TabPrints)
+			s.SetCompleter(func(line string) (c []string) {
+				for i := 0; i < 120; i++ {
+					c = append(c, fmt.Sprintf("%sitem%03d", line, i))
+				}
+				return c
+			})
+		}, suggest("", -1), "\t", "\t", key, "\r")
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", key, err)
+		}
+		if got != "item" {
+			t.Errorf("%q: got %q, want %q", key, got, "item")
+		}
+		out := p.output()
+		if !strings.Contains(out, "Display all 120 possibilities? (y or n) ") {
+			t.Errorf("%q: terminal output %q does not ask before listing", key, out)
+		}
+		if strings.Contains(out, "item119") {
+			t.Errorf("%q: terminal output %q lists the candidates", key, out)
+		}
+	}
+}
+
+func TestPtyWithoutDescriptors(t *testing.T) {
+	p := openPty(t, 80)
+	// Stand in for an SSH channel: the other end is already in raw mode, and
+	// no descriptor is handed over
+	mode, err := unix.IoctlGetTermios(p.sfd, unix.TCGETS)
+	if err != nil {
+		t.Fatalf("getting pty mode: %v", err)
+	}
+	mode.Iflag &^= unix.ICRNL
+	mode.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(p.sfd, unix.TCSETS, mode); err != nil {
+		t.Fatalf("setting pty mode: %v", err)
+	}
+	s := NewLinerWithIO(p.slave, p.slave, -1, -1)
+	defer s.Close()
+
+	got, err := p.runOn(s, func(s *State) (string, error) {
+		go func() {
+			io.WriteString(p.master, "abcdefghijklmnop")
+			p.settle()
+			s.SetColumns(12)
+			p.settle()
+			io.WriteString(p.master, "\r")
+		}()
+		return s.Prompt("> ")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got != "abcdefghijklmnop" {
+		t.Errorf("got %q, want %q", got, "abcdefghijklmnop")
+	}
+	// Redrawn scrolled to fit the new width
+	want := "\x1b[1G> {ijklmnop\x1b[0K\x1b[12G"
+	if out := p.output(); !strings.Contains(out, want) {
+		t.Errorf("terminal output %q does not contain %q", out, want)
+	}
+}
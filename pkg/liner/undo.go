@@ -0,0 +1,76 @@
+package liner
+
+// lineSnapshot is a version of the edited line.
+type lineSnapshot struct {
+	line []rune
+	pos  int
+}
+
+// undoState keeps the earlier versions of the edited line for undo and redo.
+// The editing loop marks the line before handling a key and commits it after,
+// which saves the marked version if the key changed the line.
+type undoState struct {
+	undo []lineSnapshot
+	redo []lineSnapshot
+
+	marked lineSnapshot
+	// typing is set after a typed rune, so that the next one is undone with it
+	typing bool
+}
+
+// mark remembers line and pos as they are before a key is handled.
+func (u *undoState) mark(line []rune, pos int) {
+	u.marked.line = append(u.marked.line[:0], line...)
+	u.marked.pos = pos
+}
+
+// commit saves the marked version of the line if line is different from it.
+// typed tells whether the change was typing, which groups it with the typing
+// right before it.
+func (u *undoState) commit(line []rune, pos int, typed bool) {
+	changed := string(line) != string(u.marked.line)
+	if changed {
+		if !typed || !u.typing {
+			u.undo = append(u.undo, u.snapshot())
+		}
+		u.redo = u.redo[:0]
+	}
+	u.typing = typed && changed
+}
+
+// split commits line and pos, and marks them again. It is for keys that
+// return the key that ended them, so that their change is not merged with
+// that key's.
+func (u *undoState) split(line []rune, pos int) {
+	u.commit(line, pos, false)
+	u.mark(line, pos)
+}
+
+func (u *undoState) snapshot() lineSnapshot {
+	return lineSnapshot{line: append([]rune{}, u.marked.line...), pos: u.marked.pos}
+}
+
+// step moves the line one version back (or forward, for redo), and returns
+// it. ok is false if there is no such version.
+func (u *undoState) step(line []rune, pos int, redo bool) ([]rune, int, bool) {
+	from, to := &u.undo, &u.redo
+	if redo {
+		from, to = to, from
+	}
+	if len(*from) == 0 {
+		return line, pos, false
+	}
+	snap := (*from)[len(*from)-1]
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, lineSnapshot{line: append([]rune{}, line...), pos: pos})
+	u.typing = false
+	u.mark(snap.line, snap.pos)
+	return snap.line, snap.pos, true
+}
+
+// reset forgets every version, as for a new prompt.
+func (u *undoState) reset() {
+	u.undo = u.undo[:0]
+	u.redo = u.redo[:0]
+	u.typing = false
+}
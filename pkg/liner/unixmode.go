@@ -6,7 +6,7 @@ import (
 )
 
 func (mode *termios) ApplyMode() error {
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(unix.Stdin), setTermios, uintptr(unsafe.Pointer(mode)))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(mode.fd), setTermios, uintptr(unsafe.Pointer(&mode.Termios)))
 
 	if errno != 0 {
 		return errno
@@ -23,9 +23,9 @@ func TerminalMode() (ModeApplier, error) {
 }
 
 func getMode(handle int) (*termios, error) {
-	var mode termios
+	mode := termios{fd: handle}
 	var err error
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(handle), getTermios, uintptr(unsafe.Pointer(&mode)))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(handle), getTermios, uintptr(unsafe.Pointer(&mode.Termios)))
 	if errno != 0 {
 		err = errno
 	}
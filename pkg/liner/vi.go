@@ -0,0 +1,499 @@
+package liner
+
+import (
+	"strings"
+	"unicode"
+)
+
+// viState is the state of the vi editing mode for one prompt.
+type viState struct {
+	normal   bool
+	register []rune
+
+	// keys of the command being parsed, and keys left to replay for '.'
+	keys   []interface{}
+	replay []interface{}
+
+	// lastCmd holds the keys of the last change, and lastInsert the text
+	// typed after it when the change entered insert mode
+	lastCmd    []interface{}
+	lastInsert []rune
+	recording  bool
+
+	// last f, F, t or T search, for ';' and ','
+	findKey  rune
+	findRune rune
+}
+
+// key returns the next key of the command being parsed.
+func (s *State) viKey(vi *viState) (interface{}, error) {
+	var key interface{}
+	if len(vi.replay) > 0 {
+		key, vi.replay = vi.replay[0], vi.replay[1:]
+	} else {
+		var err error
+		key, err = s.readNext()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case rune(cr), rune(lf), rune(ctrlC), rune(ctrlD):
+			// The rune reader shuts down after these, make it carry on
+			s.restartPrompt()
+		}
+	}
+	vi.keys = append(vi.keys, key)
+	return key, nil
+}
+
+// viCount reads a count prefix starting with key, and returns it along with
+// the key following it. The count is 1 if there is none.
+func (s *State) viCount(vi *viState, key interface{}) (int, interface{}, error) {
+	count := 0
+	for {
+		r, ok := key.(rune)
+		if !ok || r < '0' || r > '9' || (r == '0' && count == 0) {
+			break
+		}
+		count = count*10 + int(r-'0')
+		var err error
+		key, err = s.viKey(vi)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if count == 0 {
+		count = 1
+	}
+	return count, key, nil
+}
+
+// startInsert switches to insert mode after a change, recording the typed
+// text for '.'.
+func (vi *viState) startInsert() {
+	vi.normal = false
+	vi.recording = true
+	vi.lastInsert = nil
+}
+
+// record adds a key typed in insert mode to the text repeated by '.'.
+func (vi *viState) record(key interface{}) {
+	if !vi.recording {
+		return
+	}
+	if r, ok := key.(rune); ok {
+		switch {
+		case r == ctrlH || r == bs:
+			if len(vi.lastInsert) > 0 {
+				vi.lastInsert = vi.lastInsert[:len(vi.lastInsert)-1]
+			}
+		case r >= ' ':
+			vi.lastInsert = append(vi.lastInsert, r)
+		}
+	}
+}
+
+// viClamp keeps the normal mode cursor on a rune of its row.
+func viClamp(line []rune, pos int) int {
+	start, end := rowBounds(line, pos)
+	if pos >= end && end > start {
+		pos = end - 1
+	}
+	return pos
+}
+
+// viNormal handles key, and the keys that follow it, as a vi normal mode
+// command. It returns the new line and cursor position, along with a key that
+// the caller should handle the usual way (for example Enter or Up), or nil.
+func (s *State) viNormal(vi *viState, line []rune, pos int, key interface{}) ([]rune, int, interface{}, error) {
+	if _, ok := key.(pasted); ok {
+		// Pasted text goes in at the cursor, as in insert mode
+		return line, pos, key, nil
+	}
+	vi.keys = vi.keys[:0]
+	vi.keys = append(vi.keys, key)
+
+	count, key, err := s.viCount(vi, key)
+	if err != nil {
+		return line, pos, nil, err
+	}
+
+	start, end := rowBounds(line, pos)
+	change := true // whether the command is repeated by '.'
+
+	switch key {
+	case 'i':
+		vi.startInsert()
+	case 'a':
+		if pos < end {
+			pos++
+		}
+		vi.startInsert()
+	case 'I':
+		pos = firstNonBlank(line, start, end)
+		vi.startInsert()
+	case 'A':
+		pos = end
+		vi.startInsert()
+	case 'x', del:
+		if pos >= end {
+			s.doBeep()
+			return line, pos, nil, nil
+		}
+		n := min(count, end-pos)
+		line = vi.cut(line, pos, pos+n)
+	case 'X':
+		if pos <= start {
+			s.doBeep()
+			return line, pos, nil, nil
+		}
+		n := min(count, pos-start)
+		line = vi.cut(line, pos-n, pos)
+		pos -= n
+	case 'r':
+		c, err := s.viKey(vi)
+		if err != nil {
+			return line, pos, nil, err
+		}
+		r, ok := c.(rune)
+		if !ok || r < ' ' || pos+count > end {
+			s.doBeep()
+			return line, pos, nil, nil
+		}
+		rest := append(append([]rune{}, line[:pos]...), line[pos+count:]...)
+		if _, cut := s.constrain(rest, []rune(strings.Repeat(string(r), count))); cut {
+			s.doBeep()
+			return line, pos, nil, nil
+		}
+		line = append([]rune{}, line...)
+		for i := 0; i < count; i++ {
+			line[pos+i] = r
+		}
+		pos += count - 1
+	case 's':
+		if pos < end {
+			line = vi.cut(line, pos, pos+min(count, end-pos))
+		}
+		vi.startInsert()
+	case 'S':
+		line = vi.cut(line, start, end)
+		pos = start
+		vi.startInsert()
+	case 'D', 'C':
+		line = vi.cut(line, pos, end)
+		if key == 'C' {
+			vi.startInsert()
+		}
+	case 'd', 'c', 'y':
+		op := key.(rune)
+		next, err := s.viKey(vi)
+		if err != nil {
+			return line, pos, nil, err
+		}
+		n, next, err := s.viCount(vi, next)
+		if err != nil {
+			return line, pos, nil, err
+		}
+		var from, to int
+		if next == op {
+			// dd, cc and yy work on the whole row
+			from, to = start, end
+			if op == 'd' && to < len(line) {
+				to++ // take the newline along
+			}
+		} else {
+			if op == 'c' && (next == 'w' || next == 'W') && pos < end && !unicode.IsSpace(line[pos]) {
+				// cw changes to the end of the word, like ce
+				next = next.(rune) - 'w' + 'e'
+			}
+			target, inclusive, ok, err := s.viMotion(vi, line, pos, next, count*n)
+			if err != nil {
+				return line, pos, nil, err
+			}
+			if !ok {
+				s.doBeep()
+				return line, pos, nil, nil
+			}
+			from, to = pos, target
+			if target < pos {
+				from, to = target, pos
+			}
+			if inclusive && to < len(line) {
+				to++
+			}
+		}
+		switch op {
+		case 'y':
+			vi.register = append([]rune{}, line[from:to]...)
+			pos = from
+			change = false
+		case 'd':
+			line = vi.cut(line, from, to)
+			pos = from
+		case 'c':
+			line = vi.cut(line, from, to)
+			pos = from
+			vi.startInsert()
+		}
+	case 'p', 'P':
+		if len(vi.register) == 0 {
+			s.doBeep()
+			return line, pos, nil, nil
+		}
+		at := pos
+		if key == 'p' && pos < end {
+			at++
+		}
+		var text []rune
+		for i := 0; i < count; i++ {
+			text = append(text, vi.register...)
+		}
+		text, cut := s.constrain(line, text)
+		if cut {
+			s.doBeep()
+		}
+		if len(text) == 0 {
+			return line, pos, nil, nil
+		}
+		line = append(line[:at:at], append(text, line[at:]...)...)
+		pos = at + len(text) - 1
+	case 'u':
+		return line, pos, undo, nil
+	case rune(ctrlR):
+		return line, pos, redo, nil
+	case '.':
+		if vi.lastCmd == nil {
+			s.doBeep()
+			return line, pos, nil, nil
+		}
+		vi.replay = append([]interface{}{}, vi.lastCmd[1:]...)
+		lastCmd, lastInsert := vi.lastCmd, vi.lastInsert
+		line, pos, _, err = s.viNormal(vi, line, pos, lastCmd[0])
+		if err != nil {
+			return line, pos, nil, err
+		}
+		if !vi.normal {
+			// Type the recorded text again, and leave insert mode
+			text, cut := s.constrain(line, lastInsert)
+			if cut {
+				s.doBeep()
+			}
+			line = append(line[:pos:pos], append(append([]rune{}, text...), line[pos:]...)...)
+			pos += len(text)
+			vi.normal = true
+			vi.recording = false
+			if pos > 0 {
+				pos--
+			}
+		}
+		vi.lastCmd, vi.lastInsert = lastCmd, lastInsert
+		return line, viClamp(line, pos), nil, nil
+	case 'k', rune(ctrlP):
+		return line, pos, up, nil
+	case 'j', rune(ctrlN):
+		return line, pos, down, nil
+	case rune(cr), rune(lf), rune(ctrlC), rune(ctrlD), rune(ctrlL), up, down, winch:
+		return line, pos, key, nil
+	case rune(esc):
+		return line, pos, nil, nil
+	default:
+		target, _, ok, err := s.viMotion(vi, line, pos, key, count)
+		if err != nil {
+			return line, pos, nil, err
+		}
+		if !ok {
+			s.doBeep()
+			return line, pos, nil, nil
+		}
+		return line, viClamp(line, target), nil, nil
+	}
+
+	if change {
+		vi.lastCmd = append([]interface{}{}, vi.keys...)
+	}
+	if vi.normal {
+		pos = viClamp(line, pos)
+	}
+	return line, pos, nil, nil
+}
+
+// cut removes line[from:to] into the register, and returns the new line. The
+// original line is left untouched.
+func (vi *viState) cut(line []rune, from, to int) []rune {
+	vi.register = append([]rune{}, line[from:to]...)
+	return append(append([]rune{}, line[:from]...), line[to:]...)
+}
+
+// viMotion moves count times from pos according to key. It reports whether
+// the motion includes the rune it lands on when used with an operator, and
+// whether key is a motion at all.
+func (s *State) viMotion(vi *viState, line []rune, pos int, key interface{}, count int) (int, bool, bool, error) {
+	start, end := rowBounds(line, pos)
+	switch key {
+	case 'h', left, rune(ctrlH), rune(bs):
+		if pos <= start {
+			return pos, false, false, nil
+		}
+		return max(start, pos-count), false, true, nil
+	case 'l', right, ' ':
+		if pos >= end {
+			return pos, false, false, nil
+		}
+		return min(end, pos+count), false, true, nil
+	case '0', home:
+		return start, false, true, nil
+	case '^':
+		return firstNonBlank(line, start, end), false, true, nil
+	case '$', end:
+		if end == start {
+			return start, false, true, nil
+		}
+		return end - 1, true, true, nil
+	case 'w', 'W', wordRight:
+		big := key == 'W'
+		for i := 0; i < count && pos < end; i++ {
+			pos = nextWordStart(line, pos, end, big)
+		}
+		return pos, false, true, nil
+	case 'b', 'B', wordLeft:
+		big := key == 'B'
+		for i := 0; i < count && pos > start; i++ {
+			pos = prevWordStart(line, pos, start, big)
+		}
+		return pos, false, true, nil
+	case 'e', 'E':
+		big := key == 'E'
+		for i := 0; i < count && pos < end-1; i++ {
+			pos = nextWordEnd(line, pos, end, big)
+		}
+		return pos, true, true, nil
+	case 'f', 'F', 't', 'T':
+		c, err := s.viKey(vi)
+		if err != nil {
+			return pos, false, false, err
+		}
+		r, ok := c.(rune)
+		if !ok {
+			return pos, false, false, nil
+		}
+		vi.findKey, vi.findRune = key.(rune), r
+		target, ok := viFind(line, pos, start, end, vi.findKey, r, count, false)
+		return target, true, ok, nil
+	case ';', ',':
+		if vi.findKey == 0 {
+			return pos, false, false, nil
+		}
+		findKey := vi.findKey
+		if key == ',' {
+			// Same search, the other way
+			switch findKey {
+			case 'f':
+				findKey = 'F'
+			case 'F':
+				findKey = 'f'
+			case 't':
+				findKey = 'T'
+			case 'T':
+				findKey = 't'
+			}
+		}
+		target, ok := viFind(line, pos, start, end, findKey, vi.findRune, count, true)
+		return target, true, ok, nil
+	}
+	return pos, false, false, nil
+}
+
+// viFind looks for the count-th r from pos in the row [start, end), forward for
+// f and t, backward for F and T. t and T stop one rune before r. A repeated
+// t or T starts past the r it stopped before last time.
+func viFind(line []rune, pos, start, end int, key, r rune, count int, repeat bool) (int, bool) {
+	p := pos
+	for i := 0; i < count; i++ {
+		switch key {
+		case 'f', 't':
+			p++
+			if key == 't' && repeat && i == 0 {
+				p++ // skip the r right after the cursor
+			}
+			for p < end && line[p] != r {
+				p++
+			}
+			if p >= end {
+				return pos, false
+			}
+		case 'F', 'T':
+			p--
+			if key == 'T' && repeat && i == 0 {
+				p--
+			}
+			for p >= start && line[p] != r {
+				p--
+			}
+			if p < start {
+				return pos, false
+			}
+		}
+	}
+	switch key {
+	case 't':
+		p--
+	case 'T':
+		p++
+	}
+	return p, true
+}
+
+// runeClass sorts runes into blanks (0), word runes (1) and punctuation (2).
+// With big set, punctuation counts as word runes, as for W, B and E.
+func runeClass(r rune, big bool) int {
+	switch {
+	case unicode.IsSpace(r):
+		return 0
+	case big || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return 1
+	default:
+		return 2
+	}
+}
+
+func firstNonBlank(line []rune, start, end int) int {
+	for start < end && unicode.IsSpace(line[start]) {
+		start++
+	}
+	return start
+}
+
+func nextWordStart(line []rune, pos, end int, big bool) int {
+	class := runeClass(line[pos], big)
+	for pos < end && class != 0 && runeClass(line[pos], big) == class {
+		pos++
+	}
+	for pos < end && unicode.IsSpace(line[pos]) {
+		pos++
+	}
+	return pos
+}
+
+func prevWordStart(line []rune, pos, start int, big bool) int {
+	pos--
+	for pos > start && unicode.IsSpace(line[pos]) {
+		pos--
+	}
+	class := runeClass(line[pos], big)
+	for pos > start && runeClass(line[pos-1], big) == class {
+		pos--
+	}
+	return pos
+}
+
+func nextWordEnd(line []rune, pos, end int, big bool) int {
+	pos++
+	for pos < end-1 && unicode.IsSpace(line[pos]) {
+		pos++
+	}
+	class := runeClass(line[pos], big)
+	for pos < end-1 && runeClass(line[pos+1], big) == class {
+		pos++
+	}
+	return pos
+}
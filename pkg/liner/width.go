@@ -19,9 +19,17 @@ var zeroWidth = []*unicode.RangeTable{
 
 // countGlyphs considers zero-width characters to be zero glyphs wide,
 // and members of Chinese, Japanese, and Korean scripts to be 2 glyphs wide.
+// Escape sequences recognised by escapeLen take no space at all.
 func countGlyphs(s []rune) int {
 	n := 0
-	for _, r := range s {
+	for i := 0; i < len(s); i++ {
+		r := s[i]
+		if r == esc {
+			if l := escapeLen(s[i:]); l > 0 {
+				i += l - 1
+				continue
+			}
+		}
 		// speed up the common case
 		if r < 127 {
 			n++
@@ -65,3 +73,55 @@ func getSuffixGlyphs(s []rune, num int) []rune {
 	}
 	return s[p:]
 }
+
+// columnPos returns the number of runes of s that fit in col glyphs.
+func columnPos(s []rune, col int) int {
+	n := 0
+	for p, r := range s {
+		n += countGlyphs([]rune{r})
+		if n > col {
+			return p
+		}
+	}
+	return len(s)
+}
+
+// escapeLen returns the length of the SGR sequence (ESC [ ... m) or OSC 8
+// hyperlink (ESC ] 8 ; params ; URI, ended by BEL or ESC \) at the start of s,
+// or 0 if s does not start with one of them.
+func escapeLen(s []rune) int {
+	if len(s) < 2 || s[0] != esc {
+		return 0
+	}
+	switch s[1] {
+	case '[':
+		for i := 2; i < len(s); i++ {
+			switch {
+			case s[i] == 'm':
+				return i + 1
+			case s[i] == ';' || s[i] == ':' || ('0' <= s[i] && s[i] <= '9'):
+				// parameter
+			default:
+				return 0
+			}
+		}
+	case ']':
+		if len(s) < 4 || s[2] != '8' || s[3] != ';' {
+			return 0
+		}
+		for i := 4; i < len(s); i++ {
+			switch {
+			case s[i] == '\a':
+				return i + 1
+			case s[i] == esc:
+				if i+1 < len(s) && s[i+1] == '\\' {
+					return i + 2
+				}
+				return 0
+			case unicode.Is(unicode.C, s[i]):
+				return 0
+			}
+		}
+	}
+	return 0
+}